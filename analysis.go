@@ -0,0 +1,163 @@
+package treek
+
+import (
+	"sort"
+)
+
+// An entry on the stack, which is either a bare variable or "", along with
+// the variables first assigned while working it out
+type trackedValue struct {
+	variable string
+	assigned []string
+}
+
+// Follows what an expression would leave on the stack, remembering which
+// entries are bare variables, to see which variables it reads before
+// assigning them itself
+type variableTracker struct {
+	stack []trackedValue
+	assigned map[string]bool
+	carried map[string]bool
+}
+
+func (t *variableTracker) push(variable string, assigned []string) {
+	t.stack = append(t.stack, trackedValue {variable, assigned})
+}
+
+func (t *variableTracker) pop() trackedValue {
+	value := t.stack[len(t.stack) - 1]
+	t.stack = t.stack[:len(t.stack) - 1]
+	return value
+}
+
+// Pops an entry whose value gets used
+func (t *variableTracker) read() trackedValue {
+	value := t.pop()
+	if value.variable != "" && value.variable != "$0" && value.variable != "path" && !t.assigned[value.variable] {
+		t.carried[value.variable] = true
+	}
+	return value
+}
+
+// Reads n entries and pushes what's worked out from them
+func (t *variableTracker) combine(n int) {
+	var assigned []string
+	for i := 0; i < n; i += 1 {
+		assigned = append(assigned, t.read().assigned...)
+	}
+	t.push("", assigned)
+}
+
+func (t *variableTracker) track(instruction Instruction) {
+	switch instruction.(type) {
+		case InstructionTry:
+			// Either could run without the other, so neither assigns anything
+			// for what comes after
+			try := instruction.(InstructionTry)
+			assigned := t.assigned
+			t.assigned = copyAssigned(assigned)
+			for _, nested := range try.body.instructions {
+				t.track(nested)
+			}
+			t.read()
+			t.assigned = copyAssigned(assigned)
+			if try.variable != "" {
+				t.assigned[try.variable] = true
+			}
+			for _, nested := range try.handler.instructions {
+				t.track(nested)
+			}
+			t.read()
+			t.assigned = assigned
+			t.push("", nil)
+		case InstructionPushVariable:
+			t.push(string(instruction.(InstructionPushVariable)), nil)
+		case InstructionPushNumber, InstructionPushString:
+			t.push("", nil)
+		case InstructionCall:
+			t.combine(instruction.(InstructionCall).nargs)
+		case InstructionCallHost:
+			t.combine(instruction.(InstructionCallHost).nargs)
+		case InstructionBasic:
+			switch instruction.(InstructionBasic) {
+				case InstructionAdd, InstructionSub, InstructionMul, InstructionDiv, InstructionEqual, InstructionIndex, InstructionIn, InstructionSafeIndex:
+					// Assigning into x.y needs what's already in x, so that's a read too
+					t.combine(2)
+				case InstructionDefault:
+					// The right hand side only runs if the left is null, so
+					// it might not assign anything
+					rhs := t.read()
+					for _, variable := range rhs.assigned {
+						delete(t.assigned, variable)
+					}
+					lhs := t.read()
+					t.push("", lhs.assigned)
+				case InstructionSlice:
+					t.combine(3)
+				case InstructionNot:
+					t.combine(1)
+				case InstructionIgnore:
+					t.read()
+				case InstructionPushNull:
+					t.push("", nil)
+				case InstructionAssign:
+					value := t.read()
+					ref := t.pop()
+					assigned := append(value.assigned, ref.assigned...)
+					if ref.variable != "" && !t.assigned[ref.variable] {
+						t.assigned[ref.variable] = true
+						assigned = append(assigned, ref.variable)
+					}
+					t.push("", assigned)
+				case InstructionDup:
+					value := t.read()
+					t.push("", value.assigned)
+					t.push("", nil)
+				case InstructionDelete:
+					t.stack[len(t.stack) - 1].variable = ""
+			}
+	}
+}
+
+func copyAssigned(assigned map[string]bool) map[string]bool {
+	res := make(map[string]bool)
+	for variable := range assigned {
+		res[variable] = true
+	}
+	return res
+}
+
+// Variables whose values some action or filter reads before it has assigned
+// them, which means they carry state over from one node to another. An action
+// only runs straight after its block's filters, so it can rely on them.
+func carriedVariables(program Program) []string {
+	carried := make(map[string]bool)
+	for _, block := range program.blocks {
+		var expressions []Expression
+		for _, segment := range block.pattern.segments {
+			filter, isFilter := segment.(PatternSegmentFilter)
+			if isFilter {
+				expressions = append(expressions, filter.expr)
+			}
+		}
+		if !block.action.empty() {
+			expressions = append(expressions, block.action)
+		}
+		t := &variableTracker {
+			assigned: make(map[string]bool),
+			carried: carried,
+		}
+		for _, expr := range expressions {
+			for _, instruction := range expr.instructions {
+				t.track(instruction)
+			}
+			t.read()
+		}
+	}
+	var res []string
+	for variable := range carried {
+		res = append(res, variable)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,32 @@
+package treek
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCarriedVariables(t *testing.T) {
+	tests := []struct {
+		src string
+		want []string
+	}{
+		{`{x = 1; println(x)}`, nil},
+		{`{x += 1}`, []string {"x"}},
+		{`a {x = $0} b {println(x)}`, []string {"x"}},
+		{`a.($0 == x) {x = 1}`, []string {"x"}},
+		{`n {z = $0 ?? (y = 5); y += 1; println(y)}`, []string {"y"}},
+		{`n {y = 1; z = $0 ?? (y = 5); println(y)}`, nil},
+		{`n {z = (y = 5) ?? 1; println(y)}`, nil},
+		{`{try {x = 1} catch {x = 2}; println(x)}`, []string {"x"}},
+	}
+	for _, test := range tests {
+		program, err := Compile(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := carriedVariables(*program)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.src, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package treek
+
+import (
+	"fmt"
+)
+
+// Expressions are compiled from their instructions into a tree of closures
+// before they run, so evaluating one is just calling a function rather than
+// interpreting the instructions through a stack each time.
+type compiledExpr func(*EvalState) Value
+
+// What the compiler knows an instruction would have left on the stack
+type compiledNode struct {
+	value func(*EvalState) Value
+	// How to get the thing itself rather than its value, for assignment
+	ref func(*EvalState) StackValue
+}
+
+type compiler struct {
+	stack []compiledNode
+	// Side effects of expressions ended by ; that run before whatever is pushed next
+	pending []func(*EvalState)
+	registers int
+	// Where in the program the instruction being compiled came from
+	pos int
+}
+
+func (c *compiler) push(node compiledNode) {
+	if len(c.pending) > 0 {
+		effects := c.pending
+		c.pending = nil
+		inner := node
+		node.value = func(state *EvalState) Value {
+			for _, effect := range effects {
+				effect(state)
+			}
+			return inner.value(state)
+		}
+		if inner.ref != nil {
+			node.ref = func(state *EvalState) StackValue {
+				for _, effect := range effects {
+					effect(state)
+				}
+				return inner.ref(state)
+			}
+		}
+	}
+	c.stack = append(c.stack, node)
+}
+
+func (c *compiler) pop() compiledNode {
+	if len(c.stack) < 1 {
+		panic("Error tried to pop empty stack")
+	}
+	index := len(c.stack) - 1
+	node := c.stack[index]
+	c.stack = c.stack[:index]
+	return node
+}
+
+func (c *compiler) pushValue(value func(*EvalState) Value) {
+	c.push(compiledNode {value: value})
+}
+
+func (c *compiler) pushConstant(value Value) {
+	c.pushValue(func(*EvalState) Value {
+		return value
+	})
+}
+
+// Anything can be used as an address, but only references can be assigned to
+func (node compiledNode) toRef() func(*EvalState) StackValue {
+	if node.ref != nil {
+		return node.ref
+	}
+	return func(state *EvalState) StackValue {
+		return node.value(state)
+	}
+}
+
+func (c *compiler) binop(op func(*EvalState, Value, Value) Value) {
+	rhs := c.pop()
+	lhs := c.pop()
+	c.pushValue(func(state *EvalState) Value {
+		l := lhs.value(state)
+		result := op(state, l, rhs.value(state))
+		state.allocate(sizeOf(result))
+		return result
+	})
+}
+
+// Numbers are worked out in the program's number mode and anything else with
+// the operator of the value on the left
+func arithmetic(pos int, op InstructionBasic, operator func(Value, Value) Value) func(*EvalState, Value, Value) Value {
+	return func(state *EvalState, l Value, r Value) Value {
+		if state.strict {
+			state.checkArithmetic(pos, op, l, r)
+		}
+		_, lIsNumber := l.(ValueNumber)
+		_, lIsNull := l.(ValueNull)
+		_, rIsNumber := r.(ValueNumber)
+		if lIsNumber || (lIsNull && rIsNumber) {
+			return numberArithmetic(state.numbers, op, l.castToNumber(), r.castToNumber())
+		}
+		state.checkGrowth(op, l, r)
+		return operator(l, r)
+	}
+}
+
+func (instruction InstructionBasic) compile(c *compiler) {
+	switch instruction {
+		case InstructionAdd:
+			c.binop(arithmetic(c.pos, instruction, Value.add))
+		case InstructionSub:
+			c.binop(arithmetic(c.pos, instruction, Value.sub))
+		case InstructionDiv:
+			c.binop(arithmetic(c.pos, instruction, Value.div))
+		case InstructionMul:
+			c.binop(arithmetic(c.pos, instruction, Value.mul))
+		case InstructionEqual:
+			c.binop(func(state *EvalState, lhs Value, rhs Value) Value {
+				// Without converting, different types are never equal
+				if state.strict && lhs.typ() != rhs.typ() {
+					return ValueBool(false)
+				}
+				return lhs.equals(rhs)
+			})
+		case InstructionIgnore:
+			node := c.pop()
+			c.pending = append(c.pending, func(state *EvalState) {
+				node.value(state)
+			})
+		case InstructionPushNull:
+			c.pushConstant(ValueNull {})
+		case InstructionAssign:
+			rhs := c.pop()
+			lhs := c.pop().toRef()
+			c.pushValue(func(state *EvalState) Value {
+				address := lhs(state)
+				address.toAddress().assign(state, rhs.value(state))
+				return ValueNull {}
+			})
+		case InstructionIndex:
+			index := c.pop()
+			parentNode := c.pop()
+			parent := parentNode.toRef()
+			pos := c.pos
+			c.push(compiledNode {
+				value: func(state *EvalState) Value {
+					p := parentNode.value(state)
+					i := index.value(state)
+					if state.strict {
+						state.checkIndex(pos, p, i)
+					}
+					return p.index(i)
+				},
+				ref: func(state *EvalState) StackValue {
+					p := parent(state)
+					return IndexReference {p, index.value(state)}
+				},
+			})
+		case InstructionIn:
+			c.binop(func(_ *EvalState, key Value, container Value) Value {
+				return contains(container, key)
+			})
+		case InstructionDefault:
+			// The right hand side is only worked out if it's needed
+			rhs := c.pop()
+			lhs := c.pop()
+			c.pushValue(func(state *EvalState) Value {
+				l := lhs.value(state)
+				if l.typ() != TypeNull {
+					return l
+				}
+				return rhs.value(state)
+			})
+		case InstructionSafeIndex:
+			index := c.pop()
+			parent := c.pop()
+			c.pushValue(func(state *EvalState) Value {
+				p, isMap := parent.value(state).(ValueMap)
+				key := index.value(state)
+				if !isMap {
+					return ValueNull {}
+				}
+				return p.index(key)
+			})
+		case InstructionSlice:
+			end := c.pop()
+			start := c.pop()
+			node := c.pop()
+			c.pushValue(func(state *EvalState) Value {
+				v := node.value(state)
+				return v.slice(start.value(state), end.value(state))
+			})
+		case InstructionDup:
+			// The copy is only read after the original has been evaluated,
+			// so the original leaves itself in a register for the copy
+			node := c.pop()
+			ref := node.toRef()
+			register := c.registers
+			c.registers += 1
+			c.push(compiledNode {
+				value: func(state *EvalState) Value {
+					return state.setRegister(register, ref(state)).toValue(state)
+				},
+				ref: func(state *EvalState) StackValue {
+					return state.setRegister(register, ref(state))
+				},
+			})
+			c.pushValue(func(state *EvalState) Value {
+				return state.registers[register].toValue(state)
+			})
+		case InstructionNot:
+			node := c.pop()
+			c.pushValue(func(state *EvalState) Value {
+				return !node.value(state).castToBool()
+			})
+		case InstructionDelete:
+			ref := c.pop().toRef()
+			c.pushValue(func(state *EvalState) Value {
+				ref(state).toAddress().remove(state)
+				return ValueNull {}
+			})
+		default:
+			panic("Error: Tried to compile invalid basic instruction")
+	}
+}
+
+// Only numbers from the input are written back the way they were written, so
+// a literal like 007 is just 7
+func (n InstructionPushNumber) compile(c *compiler) {
+	number, isNumber := parseNumber(string(n))
+	if !isNumber {
+		panic("Invalid number: " + string(n))
+	}
+	if number.kind == numberFloat {
+		// The shortest text for the float is what's exact in decimal mode
+		number.text = formatFloat(number.float)
+	}
+	c.pushConstant(number)
+}
+
+func (s InstructionPushString) compile(c *compiler) {
+	c.pushConstant(ValueString(s))
+}
+
+func (variable InstructionPushVariable) compile(c *compiler) {
+	reference := VariableReference(variable)
+	c.push(compiledNode {
+		value: reference.toValue,
+		ref: func(*EvalState) StackValue {
+			return reference
+		},
+	})
+}
+
+func (call InstructionCall) compile(c *compiler) {
+	subroutine, isSubroutine := subroutineFns[call.subroutine]
+	if !isSubroutine && call.subroutine != SubroutineError {
+		panic("Error: Invalid subroutine")
+	}
+	args := make([]compiledNode, call.nargs)
+	for i := call.nargs - 1; i >= 0; i -= 1 {
+		args[i] = c.pop()
+	}
+	pos := c.pos
+	c.pushValue(func(state *EvalState) Value {
+		values := make([]Value, len(args))
+		for i, arg := range args {
+			values[i] = arg.value(state)
+		}
+		if call.subroutine == SubroutineError {
+			// Needs to know where it was called from
+			state.throw(pos, values[0])
+		}
+		return subroutine(state, values)
+	})
+}
+
+func (try InstructionTry) compile(c *compiler) {
+	body := c.nested(try.body)
+	handler := c.nested(try.handler)
+	c.pushValue(func(state *EvalState) (result Value) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			caught, isCaught := caughtValue(r)
+			if !isCaught {
+				panic(r)
+			}
+			if try.variable != "" {
+				VariableReference(try.variable).assign(state, caught)
+			}
+			result = handler(state)
+		}()
+		return body(state)
+	})
+}
+
+func (call InstructionCallHost) compile(c *compiler) {
+	args := make([]compiledNode, call.nargs)
+	for i := call.nargs - 1; i >= 0; i -= 1 {
+		args[i] = c.pop()
+	}
+	c.pushValue(func(state *EvalState) Value {
+		values := make([]Value, len(args))
+		for i, arg := range args {
+			values[i] = arg.value(state)
+		}
+		result, err := call.fn(values)
+		if err != nil {
+			panic(fmt.Errorf("%v: %w", call.name, err))
+		}
+		if result == nil {
+			return ValueNull {}
+		}
+		state.allocate(sizeOf(result))
+		return result
+	})
+}
+
+func (c *compiler) compileExpression(expr Expression) {
+	for i, instruction := range expr.instructions {
+		c.pos = expr.positions[i]
+		instruction.compile(c)
+	}
+	if len(c.stack) != 1 || len(c.pending) != 0 {
+		panic("Bug in treek, expression doesn't leave one value")
+	}
+}
+
+// Compiles an expression inside the one being compiled, sharing its registers
+func (c *compiler) nested(expr Expression) func(*EvalState) Value {
+	stack, pending, pos := c.stack, c.pending, c.pos
+	c.stack, c.pending = nil, nil
+	c.compileExpression(expr)
+	node := c.stack[0]
+	c.stack, c.pending, c.pos = stack, pending, pos
+	return node.value
+}
+
+func compile(expr Expression) compiledExpr {
+	c := &compiler {}
+	c.compileExpression(expr)
+	// There are no loops so every instruction runs at most once
+	run := c.stack[0].value
+	n := len(expr.flatten())
+	return func(state *EvalState) Value {
+		state.step(n)
+		return run(state)
+	}
+}
@@ -0,0 +1,64 @@
+package treek
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// People, each with a few orders
+func benchmarkDocument(n int) Value {
+	people := make(ValueArray, n)
+	for i := range people {
+		orders := make(ValueArray, 5)
+		for j := range orders {
+			orders[j] = ValueMap {
+				"price": intNumber(int64(j * 3 + 1)),
+				"quantity": intNumber(int64(j + 1)),
+			}
+		}
+		people[i] = ValueMap {
+			"first_name": ValueString(fmt.Sprintf("first%d", i)),
+			"last_name": ValueString(fmt.Sprintf("last%d", i % 100)),
+			"age": intNumber(int64(i % 90)),
+			"address": ValueMap {"city": ValueString("city"), "postcode": ValueString("AB1 2CD")},
+			"orders": orders,
+		}
+	}
+	return ValueMap {"people": people}
+}
+
+func benchmarkRun(b *testing.B, people int, src string) {
+	program, err := Compile(src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := benchmarkDocument(people)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		_, err := program.RunValue(context.Background(), data, io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	benchmarkRun(b, 10000, `people.*.orders.* {total += $0.price * $0.quantity; count += 1} {x = total / count}`)
+}
+
+func BenchmarkIndexing(b *testing.B) {
+	benchmarkRun(b, 10000, `people.* {city = $0.address.city; name = $0.first_name[0] + $0.last_name[-1]; first = $0.orders[0].price}`)
+}
+
+// Each assignment copies every array and map on the way down from the root,
+// so this grows with the square of the number of people and uses fewer
+func BenchmarkAssignment(b *testing.B) {
+	benchmarkRun(b, 1000, `people.*.orders.* {$0.price = $0.price * 2; $0.total = $0.price * $0.quantity}`)
+}
+
+func BenchmarkFilter(b *testing.B) {
+	benchmarkRun(b, 10000, `people.($0.last_name == "last7").age {sum += $0}`)
+}
@@ -0,0 +1,60 @@
+package treek
+
+import (
+	"fmt"
+	"errors"
+	"context"
+	"strings"
+)
+
+// An error running a program, with where in the program it happened
+type RuntimeError struct {
+	Position
+	Message string
+	// What was passed to error(), if that's where this came from
+	Value Value
+}
+
+func (err *RuntimeError) Error() string {
+	return fmt.Sprintf("%v:%v: %v", err.Line, err.Col, err.Message)
+}
+
+func (state *EvalState) failAt(pos int, format string, args ...interface{}) {
+	panic(&RuntimeError {Position: positionOf(state.src, pos), Message: fmt.Sprintf(format, args...)})
+}
+
+// Raises an error from error(value), which a catch gets the value itself from
+func (state *EvalState) throw(pos int, value Value) {
+	message := string(value.castToString())
+	if value.typ() == TypeArray || value.typ() == TypeMap {
+		var out strings.Builder
+		printSingle(&out, value)
+		message = out.String()
+	}
+	panic(&RuntimeError {positionOf(state.src, pos), message, value})
+}
+
+// What a catch gets for whatever a failing try panicked with. Running out of
+// a limit or being cancelled can't be caught, since the point of them is to
+// stop the program.
+func caughtValue(r interface{}) (Value, bool) {
+	switch r.(type) {
+		case *RuntimeError:
+			err := r.(*RuntimeError)
+			if err.Value != nil {
+				return err.Value, true
+			}
+			return ValueString(err.Error()), true
+		case error:
+			err := r.(error)
+			if errors.Is(err, ErrInstructionLimit) || errors.Is(err, ErrAllocationLimit) || errors.Is(err, ErrOutputLimit) ||
+				errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil, false
+			}
+			return ValueString(err.Error()), true
+		case string:
+			return ValueString(r.(string)), true
+		default:
+			return ValueString(fmt.Sprint(r)), true
+	}
+}
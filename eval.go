@@ -0,0 +1,1227 @@
+package treek
+
+import (
+	"io"
+	"os"
+	"context"
+	"strconv"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+type TreePathSegment interface{}
+
+type ValueType int
+const (
+	TypeNull ValueType = iota
+	TypeBool
+	TypeNumber
+	TypeString
+	TypeArray
+	TypeMap
+)
+
+type ValueNull struct {}
+type ValueBool bool
+type ValueString string
+type ValueArray []Value
+type ValueMap map[string]Value
+
+type Value interface{
+	StackValue
+	getPath([]TreePathSegment) Value
+	typ() ValueType
+	withAssignment([]Value, Value) Value
+	withDeletion([]Value) Value
+	castToBool() ValueBool
+	castToNumber() ValueNumber
+	castToString() ValueString
+	castToArray() ValueArray
+	castToMap() ValueMap
+	add(Value) Value
+	sub(Value) Value
+	mul(Value) Value
+	div(Value) Value
+	index(Value) Value
+	slice(Value, Value) Value
+	equals(Value) ValueBool
+}
+
+// Where an index is in something of the given length, with negative indices
+// counting back from the end
+func resolveIndex(w Value, length int, what string) int {
+	index := w.castToNumber().toInt()
+	if index < 0 {
+		index += length
+	}
+	if index < 0 || index >= length {
+		panic(fmt.Sprintf("Index %v is out of range for %s of length %v", w.castToNumber(), what, length))
+	}
+	return index
+}
+
+// Bounds of a slice of something of the given length. Null bounds are the
+// start and end, negative ones count back from the end, and bounds past
+// either end are moved to it.
+func sliceBounds(start Value, end Value, length int) (int, int) {
+	bound := func(w Value, missing int) int {
+		if w.typ() == TypeNull {
+			return missing
+		}
+		index := w.castToNumber().toInt()
+		if index < 0 {
+			index += length
+		}
+		if index < 0 {
+			return 0
+		} else if index > length {
+			return length
+		}
+		return index
+	}
+	from := bound(start, 0)
+	to := bound(end, length)
+	if to < from {
+		to = from
+	}
+	return from, to
+}
+
+// Whether a map has a key, or an array or string has an index, telling a
+// missing key apart from one that's there but null
+func contains(container Value, key Value) ValueBool {
+	switch container.(type) {
+		case ValueMap:
+			_, hasKey := container.(ValueMap)[string(key.castToString())]
+			return ValueBool(hasKey)
+		case ValueArray, ValueString:
+			number, isNumber := key.(ValueNumber)
+			if !isNumber || !number.isInteger() {
+				return false
+			}
+			var length int
+			if s, isString := container.(ValueString); isString {
+				length = utf8.RuneCountInString(string(s))
+			} else {
+				length = len(container.(ValueArray))
+			}
+			index := number.toInt()
+			return index >= -length && index < length
+		default:
+			return false
+	}
+}
+
+func castToType(v Value, t ValueType) Value {
+	switch t {
+		case TypeNull:
+			return ValueNull{}
+		case TypeBool:
+			return v.castToBool()
+		case TypeNumber:
+			return v.castToNumber()
+		case TypeString:
+			return v.castToString()
+		case TypeArray:
+			return v.castToArray()
+		case TypeMap:
+			return v.castToMap()
+		default:
+			panic("Unknown value type")
+	}
+}
+
+func (v ValueNull) getPath(path []TreePathSegment) Value {
+	if len(path) != 0 {
+		panic("Tried to index null")
+	}
+	return v
+}
+func (v ValueNull) typ() ValueType {
+	return TypeNull
+}
+func (v ValueNull) withAssignment(path []Value, value Value) Value {
+	if len(path) == 0 {
+		return value
+	}
+	res := make(ValueMap)
+	res[string(path[0].castToString())] = ValueNull{}.withAssignment(path[1:], value)
+	return res
+}
+func (v ValueNull) withDeletion(path []Value) Value {
+	return v
+}
+func (v ValueNull) castToBool() ValueBool {
+	return false
+}
+func (v ValueNull) castToNumber() ValueNumber {
+	return intNumber(0)
+}
+func (v ValueNull) castToString() ValueString {
+	return ""
+}
+func (v ValueNull) castToArray() ValueArray {
+	var res []Value
+	return res
+}
+func (v ValueNull) castToMap() ValueMap {
+	return make(map[string]Value)
+}
+func (v ValueNull) add(w Value) Value {
+	return w
+}
+func (v ValueNull) sub(w Value) Value {
+	typ := w.typ()
+	if typ == TypeNull {
+		return ValueNull{}
+	}
+	return castToType(v, typ).sub(w)
+}
+func (v ValueNull) mul(w Value) Value {
+	typ := w.typ()
+	if typ == TypeNull {
+		return ValueNull{}
+	}
+	return castToType(v, typ).mul(w)
+}
+func (v ValueNull) div(w Value) Value {
+	typ := w.typ()
+	if typ == TypeNull {
+		return ValueNull{}
+	}
+	return castToType(v, typ).div(w)
+}
+func (v ValueNull) index(w Value) Value {
+	return ValueNull {}
+}
+func (v ValueNull) slice(start Value, end Value) Value {
+	return ValueNull {}
+}
+func (v ValueNull) equals(w Value) ValueBool {
+	typ := w.typ()
+	if typ == TypeNull {
+		return true
+	}
+	return castToType(v, typ).equals(w)
+}
+
+func (v ValueBool) withAssignment(path []Value, value Value) Value {
+	if len(path) == 0 {
+		return value
+	}
+	res := make(ValueMap)
+	res[string(path[0].castToString())] = ValueNull{}.withAssignment(path[1:], value)
+	return res
+}
+func (v ValueBool) withDeletion(path []Value) Value {
+	panic("Tried to delete from bool")
+}
+func (v ValueBool) getPath(path []TreePathSegment) Value {
+	if len(path) != 0 {
+		panic("Tried to index bool")
+	}
+	return v
+}
+func (v ValueBool) typ() ValueType {
+	return TypeBool
+}
+func (v ValueBool) castToBool() ValueBool {
+	return v
+}
+func (v ValueBool) castToNumber() ValueNumber {
+	if v {
+		return intNumber(1)
+	} else {
+		return intNumber(0)
+	}
+}
+func (v ValueBool) castToString() ValueString {
+	if v {
+		return "true"
+	} else {
+		return "false"
+	}
+}
+func (v ValueBool) castToArray() ValueArray {
+	var res []Value
+	if v {
+		res = append(res, ValueNull{})
+	}
+	return res
+}
+func (v ValueBool) castToMap() ValueMap {
+	res := make(map[string]Value)
+	if v {
+		res[""] = ValueNull{}
+	}
+	return res
+}
+func (v ValueBool) add(w Value) Value {
+	return v || w.castToBool()
+}
+func (v ValueBool) sub(w Value) Value {
+	rhs := w.castToBool()
+	return (v || rhs) && !(v && rhs)
+}
+func (v ValueBool) mul(w Value) Value {
+	return v && w.castToBool()
+}
+func (v ValueBool) div(w Value) Value {
+	rhs := w.castToBool()
+	return (v && rhs) || !(v || rhs)
+}
+func (v ValueBool) index(w Value) Value {
+	return v
+}
+func (v ValueBool) slice(start Value, end Value) Value {
+	return v
+}
+func (v ValueBool) equals(w Value) ValueBool {
+	rhs := w.castToBool()
+	return v == rhs
+}
+
+func (v ValueNumber) withAssignment(path []Value, value Value) Value {
+	if len(path) == 0 {
+		return value
+	}
+	res := make(ValueMap)
+	res[string(path[0].castToString())] = ValueNull{}.withAssignment(path[1:], value)
+	return res
+}
+func (v ValueNumber) withDeletion(path []Value) Value {
+	panic("Tried to delete from number")
+}
+func (v ValueNumber) getPath(path []TreePathSegment) Value {
+	if len(path) != 0 {
+		panic("Tried to index number")
+	}
+	return v
+}
+func (v ValueNumber) typ() ValueType {
+	return TypeNumber
+}
+func (v ValueNumber) castToBool() ValueBool {
+	return !ValueBool(v.isZero())
+}
+func (v ValueNumber) castToNumber() ValueNumber {
+	return v
+}
+func (v ValueNumber) castToString() ValueString {
+	return ValueString(v.String())
+}
+func (v ValueNumber) castToArray() ValueArray {
+	length := v.toInt()
+	if length < 0 {
+		length = 0
+	}
+	res := make([]Value, length)
+	for i := range res {
+		res[i] = ValueNull {}
+	}
+	return res
+}
+func (v ValueNumber) castToMap() ValueMap {
+	res := make(map[string]Value)
+	res[string(v.castToString())] = ValueNull {}
+	return res
+}
+func (v ValueNumber) add(w Value) Value {
+	return numberArithmetic(NumbersFloat, InstructionAdd, v, w.castToNumber())
+}
+func (v ValueNumber) sub(w Value) Value {
+	return numberArithmetic(NumbersFloat, InstructionSub, v, w.castToNumber())
+}
+func (v ValueNumber) mul(w Value) Value {
+	return numberArithmetic(NumbersFloat, InstructionMul, v, w.castToNumber())
+}
+func (v ValueNumber) div(w Value) Value {
+	return numberArithmetic(NumbersFloat, InstructionDiv, v, w.castToNumber())
+}
+func (v ValueNumber) index(w Value) Value {
+	return v
+}
+func (v ValueNumber) slice(start Value, end Value) Value {
+	return v
+}
+func (v ValueNumber) equals(w Value) ValueBool {
+	return ValueBool(v.equalsNumber(w.castToNumber()))
+}
+
+// Strings are indexed by rune, so a character outside of ASCII is one index
+// rather than several
+func (v ValueString) withAssignment(path []Value, value Value) Value {
+	if len(path) == 0 {
+		return value
+	}
+	if len(path) > 1 {
+		panic("Cannot index string twice")
+	}
+	runes := []rune(string(v))
+	index := resolveIndex(path[0], len(runes), "string")
+	return ValueString(string(runes[:index]) + string(value.castToString()) + string(runes[index + 1:]))
+}
+func (v ValueString) withDeletion(path []Value) Value {
+	if len(path) > 1 {
+		panic("Cannot index string twice")
+	}
+	runes := []rune(string(v))
+	index := resolveIndex(path[0], len(runes), "string")
+	return ValueString(string(runes[:index]) + string(runes[index + 1:]))
+}
+func (v ValueString) getPath(path []TreePathSegment) Value {
+	if len(path) != 0 {
+		panic("Tried to index string")
+	}
+	return v
+}
+func (v ValueString) typ() ValueType {
+	return TypeString
+}
+func (v ValueString) castToBool() ValueBool {
+	if v == "" || v == "false" {
+		return false
+	} else {
+		return true
+	}
+}
+func (v ValueString) castToNumber() ValueNumber {
+	num, isNumber := parseNumber(strings.TrimSpace(string(v)))
+	if !isNumber {
+		return intNumber(0)
+	}
+	return num
+}
+func (v ValueString) castToString() ValueString {
+	return v
+}
+func (v ValueString) castToArray() ValueArray {
+	fields := strings.Fields(string(v))
+	res := make([]Value, len(fields))
+	for i, field := range fields {
+		res[i] = ValueString(field)
+	}
+	return res
+}
+func (v ValueString) castToMap() ValueMap {
+	res := make(map[string]Value)
+	res[string(v)] = ValueNull {}
+	return res
+}
+func (v ValueString) add(w Value) Value {
+	return v + w.castToString()
+}
+// Removes every occurrence of w
+func (v ValueString) sub(w Value) Value {
+	rhs := w.castToString()
+	if rhs == "" {
+		return v
+	}
+	return ValueString(strings.ReplaceAll(string(v), string(rhs), ""))
+}
+func (v ValueString) mul(w Value) Value {
+	num := w.castToNumber().toInt()
+	var builder strings.Builder
+	for i := 0; i < num; i += 1 {
+		builder.WriteString(string(v))
+	}
+	return ValueString(builder.String())
+}
+// Splits into an array of the strings between each w, or of every character
+// if w is empty
+func (v ValueString) div(w Value) Value {
+	parts := strings.Split(string(v), string(w.castToString()))
+	res := make(ValueArray, len(parts))
+	for i, part := range parts {
+		res[i] = ValueString(part)
+	}
+	return res
+}
+func (v ValueString) index(w Value) Value {
+	runes := []rune(string(v))
+	return ValueString(runes[resolveIndex(w, len(runes), "string")])
+}
+func (v ValueString) slice(start Value, end Value) Value {
+	runes := []rune(string(v))
+	from, to := sliceBounds(start, end, len(runes))
+	return ValueString(runes[from:to])
+}
+func (v ValueString) equals(w Value) ValueBool {
+	rhs := w.castToString()
+	return v == rhs
+}
+
+func (v ValueArray) withAssignment(path []Value, value Value) Value {
+	if len(path) == 0 {
+		return value
+	}
+	index := resolveIndex(path[0], len(v), "array")
+	res := v.shallowCopy()
+	res[index] = res[index].withAssignment(path[1:], value)
+	return res
+}
+func (v ValueArray) withDeletion(path []Value) Value {
+	index := resolveIndex(path[0], len(v), "array")
+	if len(path) == 1 {
+		res := make(ValueArray, 0, len(v) - 1)
+		res = append(res, v[:index]...)
+		return append(res, v[index+1:]...)
+	}
+	res := v.shallowCopy()
+	res[index] = res[index].withDeletion(path[1:])
+	return res
+}
+func (v ValueArray) getPath(path []TreePathSegment) Value {
+	if len(path) == 0 {
+		return v
+	}
+	switch path[0].(type) {
+		case int:
+			return v[path[0].(int)].getPath(path[1:])
+		default:
+			panic("Tried to index array with string")
+	}
+}
+func (v ValueArray) typ() ValueType {
+	return TypeArray
+}
+// Values are never changed once made, so copying the top level is enough for
+// an edited version to share everything it didn't touch with the original
+func (v ValueArray) shallowCopy() ValueArray {
+	res := make(ValueArray, len(v))
+	copy(res, v)
+	return res
+}
+func (v ValueArray) castToBool() ValueBool {
+	return len(v) > 0
+}
+func (v ValueArray) castToNumber() ValueNumber {
+	return intNumber(int64(len(v)))
+}
+func (v ValueArray) castToString() ValueString {
+	var builder strings.Builder
+	for i, el := range v {
+		if i != 0 {
+			builder.WriteString(" ")
+		}
+		builder.WriteString(string(el.castToString()))
+	}
+	return ValueString(builder.String())
+}
+func (v ValueArray) castToArray() ValueArray {
+	return v
+}
+func (v ValueArray) castToMap() ValueMap {
+	res := make(map[string]Value)
+	for _, el := range v {
+		res[string(el.castToString())] = ValueNull {}
+	}
+	return res
+}
+func (v ValueArray) add(w Value) Value {
+	rhs := w.castToArray()
+	res := make(ValueArray, 0, len(v) + len(rhs))
+	res = append(res, v...)
+	return append(res, rhs...)
+}
+func (v ValueArray) sub(w Value) Value {
+	width := w.castToNumber().toInt()
+	if len(v) < width {
+		return v
+	} else {
+		res := make([]Value, 2)
+		res[0] = v[0:width]
+		res[1] = v[width:]
+		return ValueArray(res)
+	}
+}
+func (v ValueArray) mul(w Value) Value {
+	var res []Value
+	target := w.castToNumber().toInt()
+	for i := 0; i < target; i += 1 {
+		res = append(res, v...)
+	}
+	return ValueArray(res)
+}
+func(v ValueArray) div(w Value) Value {
+	l := len(v)
+	parts := w.castToNumber().toInt()
+	if parts < 1 {
+		panic(fmt.Sprintf("An array can only be split into a positive number of parts, not %v", w.castToNumber()))
+	}
+	var res []Value
+	part_width := l / parts
+	remaining_els := l % parts
+	progress := 0
+	for i := 0; i < parts; i += 1 {
+		if i < remaining_els {
+			res = append(res, v[progress:progress+part_width+1])
+			progress += part_width + 1
+		} else {
+			res = append(res, v[progress:progress+part_width])
+			progress += part_width
+		}
+	}
+	return ValueArray(res)
+}
+func (v ValueArray) index(w Value) Value {
+	return v[resolveIndex(w, len(v), "array")]
+}
+func (v ValueArray) slice(start Value, end Value) Value {
+	from, to := sliceBounds(start, end, len(v))
+	return v[from:to]
+}
+func (v ValueArray) equals(w Value) ValueBool {
+	// Saves making an array of nulls just to find it's the wrong length
+	n, isNumber := w.(ValueNumber)
+	if isNumber && n.toInt() != len(v) {
+		return false
+	}
+	rhs := w.castToArray()
+	if len(v) != len(rhs) {
+		return false
+	}
+	for i, el := range v {
+		if !el.equals(rhs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v ValueMap) withAssignment(path []Value, value Value) Value {
+	if len(path) == 0 {
+		return value
+	}
+	index := string(path[0].castToString())
+	res := v.shallowCopy()
+	part, hasPart := res[index]
+	if !hasPart {
+		part = ValueNull {}
+	}
+	res[index] = part.withAssignment(path[1:], value)
+	return res
+}
+func (v ValueMap) withDeletion(path []Value) Value {
+	index := string(path[0].castToString())
+	part, hasPart := v[index]
+	if !hasPart {
+		return v
+	}
+	res := v.shallowCopy()
+	if len(path) == 1 {
+		delete(res, index)
+	} else {
+		res[index] = part.withDeletion(path[1:])
+	}
+	return res
+}
+func (v ValueMap) getPath(path []TreePathSegment) Value {
+	if len(path) == 0 {
+		return v
+	}
+	switch path[0].(type) {
+		case string:
+			return v[path[0].(string)].getPath(path[1:])
+		default:
+			panic("Tried to index map with int")
+	}
+}
+func (v ValueMap) typ() ValueType {
+	return TypeMap
+}
+func (v ValueMap) shallowCopy() ValueMap {
+	res := make(ValueMap, len(v))
+	for key, value := range v {
+		res[key] = value
+	}
+	return res
+}
+func (v ValueMap) castToBool() ValueBool {
+	return len(v) > 0
+}
+func (v ValueMap) castToNumber() ValueNumber {
+	return intNumber(int64(len(v)))
+}
+func (v ValueMap) castToString() ValueString {
+	var builder strings.Builder
+	first := true
+	for key, val := range v {
+		if !first {
+			builder.WriteString(" ")
+		}
+		builder.WriteString(key)
+		builder.WriteString(": ")
+		builder.WriteString(string(val.castToString()))
+	}
+	return ValueString(builder.String())
+}
+func (v ValueMap) castToArray() ValueArray {
+	var res []Value
+	for key := range v {
+		res = append(res, ValueString(key))
+	}
+	return res
+}
+func (v ValueMap) castToMap() ValueMap {
+	return v
+}
+func (v ValueMap) add(w Value) Value {
+	other := w.castToMap()
+	res := v.shallowCopy()
+	for key, val := range other {
+		res[key] = val
+	}
+	return res
+}
+func (v ValueMap) sub(w Value) Value {
+	res := v.shallowCopy()
+	to_remove := w.castToArray()
+	for _, key := range to_remove {
+		delete(res, string(key.castToString()))
+	}
+	return res
+}
+func (v ValueMap) mul(w Value) Value {
+	rhs := w.castToMap()
+	res := make(map[string]Value)
+	for key, val := range v {
+		val2, hasRhsVal := rhs[key]
+		if !hasRhsVal {
+			val2 = ValueNull {}
+		}
+		res[key] = ValueArray {val, val2}
+	}
+	for key, val2 := range rhs {
+		_, hasLhsVal := v[key]
+		if !hasLhsVal {
+			res[key] = ValueArray {ValueNull {}, val2}
+		}
+	}
+	return ValueMap(res)
+}
+// Splits into an array of two maps, the first with the keys in w, which can
+// be an array of keys or another map, and the second with the rest
+func (v ValueMap) div(w Value) Value {
+	keys := make(map[string]bool)
+	for _, key := range w.castToArray() {
+		keys[string(key.castToString())] = true
+	}
+	in := make(ValueMap)
+	out := make(ValueMap)
+	for key, val := range v {
+		if keys[key] {
+			in[key] = val
+		} else {
+			out[key] = val
+		}
+	}
+	return ValueArray {in, out}
+}
+func (v ValueMap) index(w Value) Value {
+	index := string(w.castToString())
+	res, hasValue := v[index]
+	if !hasValue {
+		return ValueNull {}
+	}
+	return res
+}
+func (v ValueMap) slice(start Value, end Value) Value {
+	panic("Tried to slice a map")
+}
+func (v ValueMap) equals(w Value) ValueBool {
+	rhs := w.castToMap()
+	for key, lvalue := range v {
+		rvalue, rhsHasValue := rhs[key]
+		if !rhsHasValue || !bool(lvalue.equals(rvalue)) {
+			return false
+		}
+	}
+	for key := range rhs {
+		_, lhsHasValue := v[key]
+		if !lhsHasValue {
+			return false
+		}
+	}
+	return true
+}
+
+type VariableReference string
+type IndexReference struct {
+	parent StackValue
+	index Value
+}
+
+type StackValue interface{
+	toValue(*EvalState) Value
+	toAddress() Address
+}
+
+func (v ValueNull) toValue(state *EvalState) Value {
+	return v
+}
+func (v ValueNull) toAddress() Address {
+	panic("Invalid assign to non variable")
+}
+
+func (v ValueBool) toValue(state *EvalState) Value {
+	return v
+}
+func (v ValueBool) toAddress() Address {
+	panic("Invalid assign to non variable")
+}
+
+func (v ValueNumber) toValue(state *EvalState) Value {
+	return v
+}
+func (v ValueNumber) toAddress() Address {
+	panic("Invalid assign to non variable")
+}
+
+func (v ValueString) toValue(state *EvalState) Value {
+	return v
+}
+func (v ValueString) toAddress() Address {
+	panic("Invalid assign to non variable")
+}
+
+func (v ValueArray) toValue(state *EvalState) Value {
+	return v
+}
+func (v ValueArray) toAddress() Address {
+	panic("Invalid assign to non variable")
+}
+
+func (v ValueMap) toValue(state *EvalState) Value {
+	return v
+}
+func (v ValueMap) toAddress() Address {
+	panic("Invalid assign to non variable")
+}
+
+func (v VariableReference) toValue(state *EvalState) Value {
+	value, hasValue := state.variables[string(v)]
+	if !hasValue {
+		state.variables[string(v)] = ValueNull {}
+		return ValueNull {}
+	}
+	return value
+}
+func (v VariableReference) toAddress() Address {
+	return v
+}
+
+func (v IndexReference) toValue(state *EvalState) Value {
+	return v.parent.toValue(state).index(v.index)
+}
+func (v IndexReference) toAddress() Address {
+	return v
+}
+
+type Address interface {
+	assign(*EvalState, Value)
+	assignPath(*EvalState, []Value, Value)
+	remove(*EvalState)
+	removePath(*EvalState, []Value)
+}
+
+// $0 is the current node of the document, so changes to it are written back
+func (v VariableReference) assign(state *EvalState, value Value) {
+	if v == "$0" {
+		state.assignNode(pathToValueArray(state.path), value)
+	}
+	state.allocate(sizeOf(value))
+	state.variables[string(v)] = value
+}
+func (v VariableReference) assignPath(state *EvalState, path []Value, value Value) {
+	if v == "$0" {
+		state.assignNode(append(pathToValueArray(state.path), path...), value)
+	}
+	state.allocateAssignment(v.toValue(state), path, value)
+	state.variables[string(v)] = v.toValue(state).withAssignment(path, value)
+}
+func (v VariableReference) remove(state *EvalState) {
+	if v == "$0" {
+		state.removeNode(pathToValueArray(state.path))
+		state.variables["$0"] = ValueNull {}
+		return
+	}
+	delete(state.variables, string(v))
+}
+func (v VariableReference) removePath(state *EvalState, path []Value) {
+	if v == "$0" {
+		state.removeNode(append(pathToValueArray(state.path), path...))
+	}
+	state.variables[string(v)] = v.toValue(state).withDeletion(path)
+}
+
+func (v IndexReference) assign(state *EvalState, value Value) {
+	v.assignPath(state, nil, value)
+}
+func (v IndexReference) assignPath(state *EvalState, path []Value, value Value) {
+	v.parent.toAddress().assignPath(state, append([]Value{v.index}, path...), value)
+}
+func (v IndexReference) remove(state *EvalState) {
+	v.removePath(state, nil)
+}
+func (v IndexReference) removePath(state *EvalState, path []Value) {
+	v.parent.toAddress().removePath(state, append([]Value{v.index}, path...))
+}
+
+const noneRemoved = math.MaxInt
+
+type EvalState struct {
+	variables map[string]Value
+	// Scratch space for compiled expressions
+	registers []StackValue
+	// The document, or when streaming just the subtree of it at dataPath
+	data Value
+	dataPath []TreePathSegment
+	// Path of the node currently bound to $0
+	path []TreePathSegment
+	// Path of the node the walk is currently visiting
+	walkPath []TreePathSegment
+	// Depth of the shallowest node on walkPath that has been deleted
+	removedDepth int
+	out io.Writer
+	ctx context.Context
+	limits Limits
+	// Where to log each node visited, if anywhere, and which ones
+	trace io.Writer
+	tracePrefix []string
+	numbers NumberMode
+	strict bool
+	// The program's source, for saying where runtime errors happened
+	src string
+	stderr io.Writer
+	// How much of the limits has been used up so far
+	instructions int
+	allocated int
+}
+
+func newEvalState(ctx context.Context, program Program, data Value, out io.Writer) *EvalState {
+	stderr := program.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	return &EvalState {
+		ctx: ctx,
+		limits: program.Limits,
+		trace: program.Trace.Out,
+		tracePrefix: program.Trace.prefixSegments(),
+		numbers: program.Numbers,
+		strict: program.Strict,
+		src: program.src,
+		stderr: stderr,
+		variables: make(map[string]Value),
+		data: data,
+		out: limitOutput(out, program.Limits),
+		removedDepth: noneRemoved,
+	}
+}
+
+func (state *EvalState) getNode(path []TreePathSegment) Value {
+	if state.data == nil || len(path) < len(state.dataPath) {
+		return ValueNull {}
+	}
+	return state.data.getPath(path[len(state.dataPath):])
+}
+
+func (state *EvalState) assignNode(path []Value, value Value) {
+	state.allocateAssignment(state.data, path[len(state.dataPath):], value)
+	state.data = state.data.withAssignment(path[len(state.dataPath):], value)
+}
+
+func (state *EvalState) removeNode(path []Value) {
+	if len(path) == len(state.dataPath) {
+		state.data = ValueNull {}
+	} else {
+		state.data = state.data.withDeletion(path[len(state.dataPath):])
+	}
+	if len(path) < state.removedDepth && isPathPrefix(path, state.walkPath) {
+		state.removedDepth = len(path)
+	}
+}
+
+func isPathPrefix(prefix []Value, path []TreePathSegment) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, segment := range prefix {
+		if string(segment.castToString()) != pathSegmentString(path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (state *EvalState) setRegister(register int, value StackValue) StackValue {
+	for len(state.registers) <= register {
+		state.registers = append(state.registers, nil)
+	}
+	state.registers[register] = value
+	return value
+}
+
+func pathSegmentString(pathSegment TreePathSegment) string {
+	switch pathSegment.(type) {
+		case string:
+			return pathSegment.(string)
+		case int:
+			return strconv.Itoa(pathSegment.(int))
+		default:
+			panic("Bug in treek, invalid TreePathSegment")
+	}
+}
+
+func (index PatternSegmentIndex) matches(_ *EvalState, path []TreePathSegment, pathSegment TreePathSegment) bool {
+	return string(index) == pathSegmentString(pathSegment)
+}
+
+func (filter PatternSegmentFilter) matches(state *EvalState, path []TreePathSegment, pathSegment TreePathSegment) bool {
+	state.path = path
+	state.variables["path"] = pathToValueArray(path)
+	state.variables["$0"] = state.getNode(path)
+	result := filter.compiled(state)
+	return bool(result.castToBool())
+}
+
+func (segment PatternSegmentBasic) matches(state *EvalState, path []TreePathSegment, pathSegment TreePathSegment) bool {
+	switch segment {
+		case PatternSegmentAll:
+			return true
+		default:
+			panic("Invalid basic pattern segment")
+	}
+}
+
+func matchPattern(state *EvalState, pattern Pattern, walkItem TreeWalkItem) bool {
+	if len(pattern.segments) != len(walkItem.path)  || pattern.isFirst != walkItem.first{
+		return false
+	}
+	for i, patternSegment := range pattern.segments {
+		pathSegment := walkItem.original[i]
+		if !patternSegment.matches(state, walkItem.path[0:i+1], pathSegment) {
+			return false
+		}
+	}
+	return true
+}
+
+func evalAction(state *EvalState, block Block, node TreeWalkItem) {
+	if block.action.empty() {
+		subroutinePrintln(state, []Value{state.getNode(node.path)})
+		return
+	}
+	state.path = node.path
+	state.variables["path"] = pathToValueArray(node.path)
+	state.variables["$0"] = state.getNode(node.path)
+	block.compiled(state)
+}
+
+type SubroutineFn func (*EvalState, []Value) Value
+
+var subroutineFns = map[Subroutine]SubroutineFn {
+	SubroutinePrintln: subroutinePrintln,
+	SubroutineNum: func(state *EvalState, args []Value) Value {
+		return args[0].castToNumber()
+	},
+	SubroutineStr: func(state *EvalState, args []Value) Value {
+		return args[0].castToString()
+	},
+	SubroutineBool: func(state *EvalState, args []Value) Value {
+		return args[0].castToBool()
+	},
+	SubroutineTypeof: func(state *EvalState, args []Value) Value {
+		return ValueString(typeNames[args[0].typ()])
+	},
+	SubroutineEprintln: func(state *EvalState, args []Value) Value {
+		printValues(state.stderr, args)
+		return ValueNull{}
+	},
+}
+
+// What typeof gives for each type
+var typeNames = map[ValueType]string {
+	TypeNull: "null",
+	TypeBool: "bool",
+	TypeNumber: "number",
+	TypeString: "string",
+	TypeArray: "array",
+	TypeMap: "map",
+}
+
+// With an article, for error messages like "Addition of a map and an array"
+func typeNameInSentence(typ ValueType) string {
+	if typ == TypeArray {
+		return "an " + typeNames[typ]
+	}
+	return "a " + typeNames[typ]
+}
+
+func printSingle(out io.Writer, arg Value) {
+	switch arg.(type) {
+		case ValueNull:
+			fmt.Fprint(out, "null")
+		case ValueBool:
+			fmt.Fprintf(out, "%v", bool(arg.(ValueBool)))
+		case ValueNumber:
+			fmt.Fprint(out, arg.(ValueNumber).String())
+		case ValueString:
+			fmt.Fprintf(out, "%q", string(arg.(ValueString)))
+		case ValueArray:
+			fmt.Fprint(out, "[")
+			for i, el := range arg.(ValueArray) {
+				if i != 0 {
+					fmt.Fprint(out, ", ")
+				}
+				printSingle(out, el)
+			}
+			fmt.Fprint(out, "]")
+		case ValueMap:
+			fmt.Fprint(out, "{")
+			isStart := true
+			for key, value := range arg.(ValueMap) {
+				if !isStart {
+					fmt.Fprint(out, ", ")
+				}
+				fmt.Fprintf(out, "%q: ", key)
+				printSingle(out, value)
+				isStart = false
+			}
+			fmt.Fprint(out, "}")
+	}
+}
+func printValues(out io.Writer, args []Value) {
+	for i, arg := range args {
+		if i != 0 {
+			fmt.Fprint(out, " ")
+		}
+		printSingle(out, arg)
+	}
+	fmt.Fprint(out, "\n")
+}
+func subroutinePrintln(state *EvalState, args []Value) Value {
+	printValues(state.out, args)
+	return ValueNull{}
+}
+
+func pathToValueArray(path []TreePathSegment) ValueArray {
+	value := make(ValueArray, len(path))
+	for i, segment := range path {
+		switch segment.(type) {
+			case string:
+				value[i] = ValueString(segment.(string))
+			case int:
+				value[i] = intNumber(int64(segment.(int)))
+		}
+	}
+	return value
+}
+
+type TreeWalkItem struct {
+	path []TreePathSegment
+	// The path with each index as it was before any earlier siblings were
+	// deleted, which is what patterns match against
+	original []TreePathSegment
+	first bool
+	// Where the path got to in the program's pattern trie
+	matches matchSet
+}
+
+// Walks the document as it is being edited, so children are read after the
+// pre-order visit and deleted nodes are skipped without losing their siblings.
+// Subtrees that no pattern can reach aren't visited at all.
+func walkPaths(state *EvalState, path, original []TreePathSegment, matches matchSet, visit func(TreeWalkItem)) {
+	if len(matches) == 0 {
+		return
+	}
+	visit(TreeWalkItem {path, original, true, matches})
+	if state.removedDepth <= len(path) {
+		return
+	}
+	switch state.getNode(path).(type) {
+		case ValueNull, ValueBool, ValueNumber, ValueString:
+		case ValueArray:
+			// Each element is visited once, however many before it are deleted
+			removed := 0
+			for i := 0; ; i += 1 {
+				array, isArray := state.getNode(path).(ValueArray)
+				if !isArray || i - removed >= len(array) {
+					break
+				}
+				walkPaths(state, append(path, i - removed), append(original, i), matches.step(i), visit)
+				if state.removedDepth <= len(path) {
+					return
+				}
+				if state.removedDepth == len(path) + 1 {
+					state.removedDepth = noneRemoved
+					removed += 1
+				}
+			}
+		case ValueMap:
+			var keys []string
+			for key := range state.getNode(path).(ValueMap) {
+				keys = append(keys, key)
+			}
+			for _, key := range keys {
+				node, isMap := state.getNode(path).(ValueMap)
+				if !isMap {
+					break
+				}
+				if _, hasKey := node[key]; !hasKey {
+					continue
+				}
+				walkPaths(state, append(path, key), append(original, key), matches.step(key), visit)
+				if state.removedDepth <= len(path) {
+					return
+				}
+				if state.removedDepth == len(path) + 1 {
+					state.removedDepth = noneRemoved
+				}
+			}
+	}
+	visit(TreeWalkItem {path, original, false, matches})
+}
+
+func visitNode(state *EvalState, program Program, node TreeWalkItem) {
+	select {
+		case <-state.ctx.Done():
+			panic(state.ctx.Err())
+		default:
+	}
+	state.walkPath = node.path
+	tracing := state.tracing(node.path)
+	if tracing {
+		state.traceNode(node)
+	}
+	for _, i := range node.matches.blocks() {
+		if state.removedDepth <= len(node.path) {
+			break
+		}
+		block := program.blocks[i]
+		var matched bool
+		if tracing {
+			matched = state.traceMatch(program, i, node)
+		} else {
+			matched = matchPattern(state, block.pattern, node)
+		}
+		if matched {
+			evalAction(state, block,  node)
+		}
+	}
+}
+
+func walkProgram(state *EvalState, program Program) {
+	walkPaths(state, nil, nil, matchSet {program.trie}, func(node TreeWalkItem) {
+		visitNode(state, program, node)
+	})
+}
+
+func eval(ctx context.Context, program Program, data Value, out io.Writer) Value {
+	state := newEvalState(ctx, program, data, out)
+	walkProgram(state, program)
+	return state.data
+}
@@ -0,0 +1,72 @@
+package treek
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStringAndMapArithmetic(t *testing.T) {
+	a, b, c := intNumber(1), intNumber(2), intNumber(3)
+	data := ValueMap {
+		"m": ValueMap {"a": a, "b": b, "c": c},
+		"keys": ValueArray {ValueString("a"), ValueString("c")},
+		"other": ValueMap {"b": ValueNull {}},
+	}
+	tests := []struct {
+		expression string
+		want Value
+	}{
+		{`"a-b-c" - "-"`, ValueString("abc")},
+		{`"a,b" / ","`, ValueArray {ValueString("a"), ValueString("b")}},
+		{`"ab" / ""`, ValueArray {ValueString("a"), ValueString("b")}},
+		{`"" / ","`, ValueArray {ValueString("")}},
+		{`$0.m / $0.keys`, ValueArray {ValueMap {"a": a, "c": c}, ValueMap {"b": b}}},
+		{`$0.m / $0.other`, ValueArray {ValueMap {"b": b}, ValueMap {"a": a, "c": c}}},
+		{`$0.m - $0.keys`, ValueMap {"b": b}},
+	}
+	for _, test := range tests {
+		program, err := Compile("{$0.result = " + test.expression + "}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := program.RunValue(context.Background(), data, io.Discard)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+		} else if got := result.(ValueMap)["result"]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestDeleteArrayElements(t *testing.T) {
+	a, b, c := intNumber(1), intNumber(2), intNumber(3)
+	data := ValueMap {"a": ValueArray {a, b, c}}
+	tests := []struct {
+		src string
+		want Value
+		output string
+	}{
+		{`a.0 {delete} a.* {println(path, $0)}`, ValueArray {b, c}, "[\"a\", 0] 2\n[\"a\", 1] 3\n"},
+		{`a.0 {delete} a.1 {delete}`, ValueArray {c}, ""},
+		{`a.* {delete} a.* {println($0)}`, ValueArray {}, ""},
+		{`a.1 {delete} a.* {println(path, $0)}`, ValueArray {a, c}, "[\"a\", 0] 1\n[\"a\", 1] 3\n"},
+	}
+	for _, test := range tests {
+		program, err := Compile(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output strings.Builder
+		result, err := program.RunValue(context.Background(), data, &output)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+		} else if got := result.(ValueMap)["a"]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.src, got, test.want)
+		} else if output.String() != test.output {
+			t.Errorf("%s: printed %q, want %q", test.src, output.String(), test.output)
+		}
+	}
+}
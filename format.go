@@ -0,0 +1,378 @@
+package treek
+
+import (
+	"strings"
+)
+
+// A block as the formatter sees it, which is just its tokens
+type fmtBlock struct {
+	// Comments on their own lines before the block, along with any from
+	// inside the pattern since there's nowhere to put them there
+	comments []Token
+	// Whether there was a blank line before the block
+	spaced bool
+	pattern []Token
+	hasAction bool
+	action []Token
+	// Whether the action was written over more than one line
+	multiline bool
+	trailing string
+}
+
+type formatter struct {
+	src string
+	tokens []Token
+	pos int
+}
+
+// Whether nothing but spaces comes between the end of one token and the start
+// of the next
+func (f *formatter) sameLine(a Token, b Token) bool {
+	return !strings.Contains(f.src[a.pos + len(a.val):b.pos], "\n")
+}
+
+func (f *formatter) blankLineBetween(a Token, b Token) bool {
+	between := f.src[a.pos + len(a.val):b.pos]
+	return strings.Count(between, "\n") > 1
+}
+
+func (f *formatter) peek() Token {
+	return f.tokens[f.pos]
+}
+
+func (f *formatter) next() Token {
+	token := f.tokens[f.pos]
+	f.pos += 1
+	return token
+}
+
+func (f *formatter) done() bool {
+	return f.pos >= len(f.tokens)
+}
+
+// Takes tokens up to and including the one closing the bracket just taken
+func (f *formatter) bracketed() []Token {
+	var tokens []Token
+	depth := 1
+	for !f.done() {
+		token := f.next()
+		switch token.typ {
+			case TokenLParen, TokenLBrace, TokenLBrack:
+				depth += 1
+			case TokenRParen, TokenRBrace, TokenRBrack:
+				depth -= 1
+		}
+		if depth == 0 {
+			return tokens
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func isPatternSegmentStart(typ TokenType) bool {
+	return typ == TokenIndexPattern || typ == TokenAst || typ == TokenLParen
+}
+
+func (f *formatter) block() fmtBlock {
+	var block fmtBlock
+	if f.peek().typ == TokenCircum {
+		block.pattern = append(block.pattern, f.next())
+	}
+	for !f.done() && isPatternSegmentStart(f.peek().typ) {
+		segment := f.next()
+		block.pattern = append(block.pattern, segment)
+		if segment.typ == TokenLParen {
+			for _, token := range f.bracketed() {
+				if token.typ == TokenComment {
+					block.comments = append(block.comments, token)
+				} else {
+					block.pattern = append(block.pattern, token)
+				}
+			}
+			block.pattern = append(block.pattern, Token {typ: TokenRParen, val: ")"})
+		}
+		if f.done() || f.peek().typ != TokenDot {
+			break
+		}
+		block.pattern = append(block.pattern, f.next())
+	}
+	for !f.done() && f.peek().typ == TokenComment {
+		block.comments = append(block.comments, f.next())
+	}
+	if !f.done() && f.peek().typ == TokenLBrace {
+		open := f.next()
+		block.hasAction = true
+		block.action = f.bracketed()
+		close := f.tokens[f.pos - 1]
+		block.multiline = !f.sameLine(open, close)
+	}
+	return block
+}
+
+// Whether an operator after this token would be a prefix one, like the - in -1
+func isPrefix(prev Token) bool {
+	switch prev.typ {
+		case TokenErr, TokenLParen, TokenLBrack, TokenComma, TokenSemicolon, TokenColon, TokenNot, TokenNotEqual:
+			return true
+	}
+	_, isOp := binops[prev.typ]
+	_, isAssign := assigns[prev.typ]
+	return isOp || isAssign || isIn(prev)
+}
+
+// in is an operator that lexes as an identifier
+func isIn(token Token) bool {
+	return token.typ == TokenIdentifier && token.val == "in"
+}
+
+// Gives each operator a space either side and each comma and semicolon a
+// space after, and nothing else any spaces. Comments end the line, with what
+// follows carrying on at indent.
+func formatExpression(tokens []Token, indent string) string {
+	var out strings.Builder
+	var prev Token
+	prevIsNegation := false
+	for i, token := range tokens {
+		if token.typ == TokenComment {
+			out.WriteString(" " + strings.TrimRight(token.val, " \t\r"))
+			if i < len(tokens) - 1 {
+				out.WriteString("\n" + indent)
+			}
+			prev = Token {}
+			continue
+		}
+		space := false
+		if i > 0 && prev.typ != TokenErr {
+			_, prevIsOp := binops[prev.typ]
+			_, prevIsAssign := assigns[prev.typ]
+			_, isOp := binops[token.typ]
+			_, isAssign := assigns[token.typ]
+			prevIsWord := prev.typ == TokenIdentifier || prev.typ == TokenNumber
+			isWord := token.typ == TokenIdentifier || token.typ == TokenNumber
+			// try {...} catch (e) {...}
+			isCatch := (token.typ == TokenLBrace) || (prev.typ == TokenRBrace && token.typ == TokenIdentifier) ||
+				(prev.typ == TokenIdentifier && prev.val == "catch" && token.typ == TokenLParen)
+			space = prevIsOp || prevIsAssign || isOp || isAssign || isIn(prev) || isIn(token) || isCatch ||
+				prev.typ == TokenNotEqual || token.typ == TokenNotEqual ||
+				prev.typ == TokenComma || prev.typ == TokenSemicolon ||
+				(prevIsWord && isWord)
+		}
+		isNegation := token.typ == TokenSub && isPrefix(prev)
+		if isNegation {
+			// Spaced like an operand rather than an operator
+			_, prevIsOp := binops[prev.typ]
+			_, prevIsAssign := assigns[prev.typ]
+			space = i > 0 && (prevIsOp || prevIsAssign || isIn(prev) || prev.typ == TokenNotEqual ||
+				prev.typ == TokenComma || prev.typ == TokenSemicolon)
+		}
+		if prevIsNegation {
+			space = false
+		}
+		if space {
+			out.WriteString(" ")
+		}
+		out.WriteString(token.val)
+		prevIsNegation = isNegation
+		prev = token
+	}
+	return out.String()
+}
+
+func formatPattern(tokens []Token) string {
+	var out strings.Builder
+	for i := 0; i < len(tokens); i += 1 {
+		if tokens[i].typ != TokenLParen {
+			out.WriteString(tokens[i].val)
+			continue
+		}
+		start := i + 1
+		depth := 1
+		for depth > 0 {
+			i += 1
+			switch tokens[i].typ {
+				case TokenLParen:
+					depth += 1
+				case TokenRParen:
+					depth -= 1
+			}
+		}
+		out.WriteString("(" + formatExpression(tokens[start:i], "") + ")")
+	}
+	return out.String()
+}
+
+const formatWidth = 80
+
+// An action over several lines has a statement on each, with comments kept
+// on the same line as the statement they followed. indent is what the line
+// with the opening brace is indented by.
+func (f *formatter) multilineAction(tokens []Token, indent string) string {
+	var lines []string
+	var statement []Token
+	var prev Token
+	depth := 0
+	for _, token := range tokens {
+		if token.typ == TokenComment && len(statement) == 0 {
+			if prev.typ == TokenSemicolon && f.sameLine(prev, token) {
+				lines[len(lines) - 1] += " " + strings.TrimRight(token.val, " \t\r")
+			} else {
+				lines = append(lines, indent + "\t" + strings.TrimRight(token.val, " \t\r"))
+			}
+			prev = token
+			continue
+		}
+		switch token.typ {
+			case TokenLParen, TokenLBrace, TokenLBrack:
+				depth += 1
+			case TokenRParen, TokenRBrace, TokenRBrack:
+				depth -= 1
+			case TokenSemicolon:
+				if depth == 0 {
+					lines = append(lines, indent + "\t" + f.statement(statement, indent + "\t") + ";")
+					statement = nil
+					prev = token
+					continue
+				}
+		}
+		statement = append(statement, token)
+		prev = token
+	}
+	if len(statement) > 0 {
+		lines = append(lines, indent + "\t" + f.statement(statement, indent + "\t"))
+	}
+	return "{\n" + strings.Join(lines, "\n") + "\n" + indent + "}"
+}
+
+// A statement whose try or catch body was written over more than one line
+// has its bodies laid out like actions of their own
+func (f *formatter) statement(tokens []Token, indent string) string {
+	// Where each brace that isn't inside anything else opens and closes
+	var bodies [][2]int
+	multiline := false
+	depth := 0
+	for i, token := range tokens {
+		switch token.typ {
+			case TokenLParen, TokenLBrace, TokenLBrack:
+				if depth == 0 && token.typ == TokenLBrace {
+					bodies = append(bodies, [2]int {i, i})
+				}
+				depth += 1
+			case TokenRParen, TokenRBrace, TokenRBrack:
+				depth -= 1
+				if depth == 0 && token.typ == TokenRBrace {
+					body := &bodies[len(bodies) - 1]
+					body[1] = i
+					multiline = multiline || !f.sameLine(tokens[body[0]], token)
+				}
+		}
+	}
+	if !multiline {
+		return formatExpression(tokens, indent + "\t")
+	}
+	var out strings.Builder
+	from := 0
+	for _, body := range bodies {
+		if from > 0 {
+			out.WriteString(" ")
+		}
+		if body[0] > from {
+			out.WriteString(formatExpression(tokens[from:body[0]], indent + "\t") + " ")
+		}
+		out.WriteString(f.multilineAction(tokens[body[0] + 1:body[1]], indent))
+		from = body[1] + 1
+	}
+	if from < len(tokens) {
+		out.WriteString(" " + formatExpression(tokens[from:], indent + "\t"))
+	}
+	return out.String()
+}
+
+func (f *formatter) format() string {
+	var out strings.Builder
+	var prev Token
+	first := true
+	for !f.done() {
+		var comments []Token
+		spaced := false
+		if !first && f.blankLineBetween(prev, f.peek()) {
+			spaced = true
+		}
+		for !f.done() && f.peek().typ == TokenComment {
+			comment := f.next()
+			if !first && len(comments) == 0 && f.sameLine(prev, comment) {
+				// Goes on the end of the block before
+				trimmed := strings.TrimRight(out.String(), "\n")
+				out.Reset()
+				out.WriteString(trimmed + " " + strings.TrimRight(comment.val, " \t\r") + "\n")
+				if !f.done() && f.blankLineBetween(comment, f.peek()) {
+					spaced = true
+				}
+			} else {
+				comments = append(comments, comment)
+			}
+			prev = comment
+		}
+		if f.done() {
+			if spaced {
+				out.WriteString("\n")
+			}
+			for _, comment := range comments {
+				out.WriteString(strings.TrimRight(comment.val, " \t\r") + "\n")
+			}
+			break
+		}
+		block := f.block()
+		prev = f.tokens[f.pos - 1]
+		if spaced {
+			out.WriteString("\n")
+		}
+		for _, comment := range append(comments, block.comments...) {
+			out.WriteString(strings.TrimRight(comment.val, " \t\r") + "\n")
+		}
+		pattern := formatPattern(block.pattern)
+		out.WriteString(pattern)
+		if block.hasAction {
+			if pattern != "" && pattern != "^" {
+				out.WriteString(" ")
+			}
+			hasComments := false
+			for _, token := range block.action {
+				if token.typ == TokenComment {
+					hasComments = true
+				}
+			}
+			inline := "{" + formatExpression(block.action, "") + "}"
+			if block.multiline || hasComments || len(pattern) + len(inline) > formatWidth {
+				out.WriteString(f.multilineAction(block.action, ""))
+			} else {
+				out.WriteString(inline)
+			}
+		}
+		out.WriteString("\n")
+		first = false
+	}
+	return out.String()
+}
+
+// Lays a program out the standard way, with a block on each line, spaces
+// around operators and long actions split into a statement per line.
+// Comments and single blank lines between blocks are kept.
+func Format(program string) (formatted string, err error) {
+	defer recoverError(&err)
+	parse(lex(program), anyFunctions)
+	l := lex(program)
+	var tokens []Token
+	for {
+		token := l.nextToken()
+		if token.typ == TokenEOF {
+			break
+		}
+		tokens = append(tokens, token)
+	}
+	f := &formatter {
+		src: program,
+		tokens: tokens,
+	}
+	return f.format(), nil
+}
@@ -0,0 +1,51 @@
+package treek
+
+import (
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		src string
+		want string
+	}{
+		{"a.b{x=1;println( x )}", "a.b {x = 1; println(x)}\n"},
+		{"{x=-1; y = $0[ -1]}", "{x = -1; y = $0[-1]}\n"},
+		{"{x = try {1} catch {2}}", "{x = try {1} catch {2}}\n"},
+		{
+			"orders.* {\n\ttry {total += $0.price; # add\n\t\tcount += 1} catch (e) {eprintln(e)}\n}",
+			"orders.* {\n\ttry {\n\t\ttotal += $0.price; # add\n\t\tcount += 1\n\t} catch (e) {\n\t\teprintln(e)\n\t}\n}\n",
+		},
+		{
+			"a {z = try {\na = 1\n} catch {b = 2} ?? 4; w = 1}",
+			"a {\n\tz = try {\n\t\ta = 1\n\t} catch {\n\t\tb = 2\n\t} ?? 4;\n\tw = 1\n}\n",
+		},
+		{
+			"# header\na {x = 1}   # trailing\n\n\n\nb {y = 2}",
+			"# header\na {x = 1} # trailing\n\nb {y = 2}\n",
+		},
+		{
+			"people.* {\ntotal += $0.age; # running total\ncount += 1\n}",
+			"people.* {\n\ttotal += $0.age; # running total\n\tcount += 1\n}\n",
+		},
+		{
+			"people.*.orders.* {totalPrice = totalPrice + $0.price * $0.quantity; orderCount = orderCount + 1}",
+			"people.*.orders.* {\n\ttotalPrice = totalPrice + $0.price * $0.quantity;\n\torderCount = orderCount + 1\n}\n",
+		},
+	}
+	for _, test := range tests {
+		got, err := Format(test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.src, got, test.want)
+		}
+		// Formatting again shouldn't change anything
+		again, err := Format(got)
+		if err != nil || again != got {
+			t.Errorf("%q: formatting again gave %q, %v", test.src, again, err)
+		}
+	}
+}
@@ -1,3 +1,3 @@
-module main
+module github.com/shtanton/treek
 
 go 1.18
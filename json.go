@@ -0,0 +1,194 @@
+package treek
+
+import (
+	"io"
+	"fmt"
+	"math/big"
+	"encoding/json"
+)
+
+func tokenToValue(token json.Token) Value {
+	switch token.(type) {
+		case nil:
+			return ValueNull {}
+		case bool:
+			return ValueBool(token.(bool))
+		case json.Number:
+			return readNumber(string(token.(json.Number)))
+		case string:
+			return ValueString(token.(string))
+		default:
+			panic("Can't convert JSON token to value")
+	}
+}
+
+func readValue(dec *json.Decoder) (value Value, empty bool) {
+	if !dec.More() {
+		return nil, true
+	}
+	t, err := dec.Token()
+	if err == io.EOF {
+		return nil, true
+	} else if err != nil {
+		panic("Invalid JSON")
+	}
+	switch t.(type) {
+		case nil, string, json.Number, bool:
+			v := tokenToValue(t)
+			return v, false
+		case json.Delim:
+			switch rune(t.(json.Delim)) {
+				case '[':
+					var value []Value
+					for dec.More() {
+						v, empty := readValue(dec)
+						if empty {
+							break
+						}
+						value = append(value, v)
+					}
+					t, err := dec.Token()
+					if err != nil {
+						panic("Invalid JSON")
+					}
+					delim, isDelim := t.(json.Delim)
+					if !isDelim || delim != ']' {
+						panic("Expected ] in JSON")
+					}
+					v := ValueArray(value)
+					return v, false
+				case '{':
+					value := make(map[string]Value)
+					for dec.More() {
+						t, _ := dec.Token()
+						key, keyIsString := t.(string)
+						if !keyIsString {
+							panic("Invalid JSON")
+						}
+						v, empty := readValue(dec)
+						if empty {
+							panic("Invalid JSON")
+						}
+						value[key] = v
+					}
+					t, err := dec.Token()
+					if err != nil {
+						panic("Invalid JSON")
+					}
+					delim, isDelim := t.(json.Delim)
+					if !isDelim || delim != '}' {
+						panic("Expected } in JSON")
+					}
+					v := ValueMap(value)
+					return v, false
+				default:
+					panic("Error parsing JSON")
+			}
+		default:
+			panic("Invalid JSON token")
+	}
+}
+
+// Reads a single JSON value
+func ReadJson(r io.Reader) (value Value, err error) {
+	defer recoverError(&err)
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	value, isEmpty := readValue(dec)
+	if isEmpty {
+		panic("Missing JSON input")
+	}
+	return value, nil
+}
+
+// Converts a value to what encoding/json would have decoded it as, with
+// numbers as json.Number so that none of them lose any precision
+func ToGo(value Value) interface{} {
+	switch value.(type) {
+		case ValueNull:
+			return nil
+		case ValueBool:
+			return bool(value.(ValueBool))
+		case ValueNumber:
+			return json.Number(value.(ValueNumber).String())
+		case ValueString:
+			return string(value.(ValueString))
+		case ValueArray:
+			res := make([]interface{}, len(value.(ValueArray)))
+			for i, el := range value.(ValueArray) {
+				res[i] = ToGo(el)
+			}
+			return res
+		case ValueMap:
+			res := make(map[string]interface{})
+			for key, el := range value.(ValueMap) {
+				res[key] = ToGo(el)
+			}
+			return res
+		default:
+			panic("Can't convert value to JSON")
+	}
+}
+
+// Converts the kind of thing encoding/json decodes into, or that could be
+// encoded as JSON without any help, to a value
+func FromGo(v interface{}) (Value, error) {
+	switch v.(type) {
+		case nil:
+			return ValueNull {}, nil
+		case Value:
+			return v.(Value), nil
+		case bool:
+			return ValueBool(v.(bool)), nil
+		case float64:
+			return floatNumber(v.(float64)), nil
+		case float32:
+			return floatNumber(float64(v.(float32))), nil
+		case int:
+			return intNumber(int64(v.(int))), nil
+		case int64:
+			return intNumber(v.(int64)), nil
+		case *big.Int:
+			return bigNumber(new(big.Int).Set(v.(*big.Int))), nil
+		case *big.Rat:
+			return decimalNumber(new(big.Rat).Set(v.(*big.Rat))), nil
+		case json.Number:
+			num, isNumber := parseNumber(string(v.(json.Number)))
+			if !isNumber {
+				return nil, fmt.Errorf("treek: invalid number %q", v)
+			}
+			num.text = string(v.(json.Number))
+			return num, nil
+		case string:
+			return ValueString(v.(string)), nil
+		case []interface{}:
+			res := make(ValueArray, len(v.([]interface{})))
+			for i, el := range v.([]interface{}) {
+				value, err := FromGo(el)
+				if err != nil {
+					return nil, err
+				}
+				res[i] = value
+			}
+			return res, nil
+		case map[string]interface{}:
+			res := make(ValueMap)
+			for key, el := range v.(map[string]interface{}) {
+				value, err := FromGo(el)
+				if err != nil {
+					return nil, err
+				}
+				res[key] = value
+			}
+			return res, nil
+		default:
+			return nil, fmt.Errorf("treek: can't convert %T to a value", v)
+	}
+}
+
+func WriteJson(w io.Writer, value Value) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	return enc.Encode(ToGo(value))
+}
@@ -0,0 +1,334 @@
+package treek
+
+import (
+	"io"
+	"bytes"
+	"sort"
+	"strings"
+	"encoding/json"
+)
+
+// A JSON value along with where it came from in the source, so that an edited
+// document can be written back with everything that didn't change left byte
+// for byte as it was
+type jsonSyntax struct {
+	start, end int
+	value Value
+	elements []*jsonSyntax
+	members []jsonMember
+}
+
+type jsonMember struct {
+	key string
+	start, keyEnd int
+	value *jsonSyntax
+}
+
+type JsonDocument struct {
+	src []byte
+	root *jsonSyntax
+}
+
+type syntaxReader struct {
+	src []byte
+	dec *json.Decoder
+}
+
+// The decoder skips separators itself, so find where the next token really starts
+func (r *syntaxReader) tokenStart() int {
+	pos := int(r.dec.InputOffset())
+	for pos < len(r.src) && strings.IndexByte(" \t\r\n,:", r.src[pos]) >= 0 {
+		pos += 1
+	}
+	return pos
+}
+
+func (r *syntaxReader) token() json.Token {
+	t, err := r.dec.Token()
+	if err != nil {
+		panic("Invalid JSON")
+	}
+	return t
+}
+
+func (r *syntaxReader) read() *jsonSyntax {
+	node := &jsonSyntax {start: r.tokenStart()}
+	t := r.token()
+	switch t.(type) {
+		case nil, string, json.Number, bool:
+			node.value = tokenToValue(t)
+		case json.Delim:
+			switch rune(t.(json.Delim)) {
+				case '[':
+					value := ValueArray {}
+					for r.dec.More() {
+						el := r.read()
+						node.elements = append(node.elements, el)
+						value = append(value, el.value)
+					}
+					delim, isDelim := r.token().(json.Delim)
+					if !isDelim || delim != ']' {
+						panic("Expected ] in JSON")
+					}
+					node.value = value
+				case '{':
+					value := make(ValueMap)
+					for r.dec.More() {
+						start := r.tokenStart()
+						key, keyIsString := r.token().(string)
+						if !keyIsString {
+							panic("Invalid JSON")
+						}
+						keyEnd := int(r.dec.InputOffset())
+						el := r.read()
+						node.members = append(node.members, jsonMember {key, start, keyEnd, el})
+						value[key] = el.value
+					}
+					delim, isDelim := r.token().(json.Delim)
+					if !isDelim || delim != '}' {
+						panic("Expected } in JSON")
+					}
+					node.value = value
+				default:
+					panic("Error parsing JSON")
+			}
+		default:
+			panic("Invalid JSON token")
+	}
+	node.end = int(r.dec.InputOffset())
+	return node
+}
+
+// Reads a JSON value, remembering how it was written so it can be written back
+// the same way after being edited
+func ReadJsonDocument(src []byte) (doc *JsonDocument, err error) {
+	defer recoverError(&err)
+	if len(bytes.TrimSpace(src)) == 0 {
+		panic("Missing JSON input")
+	}
+	r := &syntaxReader {
+		src: src,
+		dec: json.NewDecoder(bytes.NewReader(src)),
+	}
+	r.dec.UseNumber()
+	root := r.read()
+	// Anything after the value, like the rest of line-delimited JSON, would
+	// otherwise be written back untouched without ever being edited
+	if len(bytes.TrimSpace(src[root.end:])) != 0 {
+		panic("Unexpected data after the JSON value, only a single value can be edited")
+	}
+	return &JsonDocument {
+		src: src,
+		root: root,
+	}, nil
+}
+
+func (doc *JsonDocument) Value() Value {
+	return doc.root.value
+}
+
+// Strict equality, unlike equals which casts
+func sameValue(a Value, b Value) bool {
+	switch a.(type) {
+		case ValueArray:
+			rhs, isArray := b.(ValueArray)
+			if !isArray || len(a.(ValueArray)) != len(rhs) {
+				return false
+			}
+			for i, el := range a.(ValueArray) {
+				if !sameValue(el, rhs[i]) {
+					return false
+				}
+			}
+			return true
+		case ValueMap:
+			rhs, isMap := b.(ValueMap)
+			if !isMap || len(a.(ValueMap)) != len(rhs) {
+				return false
+			}
+			for key, el := range a.(ValueMap) {
+				rvalue, hasValue := rhs[key]
+				if !hasValue || !sameValue(el, rvalue) {
+					return false
+				}
+			}
+			return true
+		default:
+			return a == b
+	}
+}
+
+type syntaxWriter struct {
+	src []byte
+	out bytes.Buffer
+	// One level of indentation as the document uses it, empty if it's all on one line
+	indent string
+}
+
+func guessIndent(src []byte) string {
+	lines := bytes.Split(src, []byte("\n"))
+	for _, line := range lines[1:] {
+		trimmed := bytes.TrimLeft(line, " \t")
+		if len(trimmed) != len(line) {
+			return string(line[:len(line) - len(trimmed)])
+		}
+	}
+	return ""
+}
+
+// The indentation of the line that pos is on
+func (w *syntaxWriter) lineIndent(pos int) string {
+	start := bytes.LastIndexByte(w.src[:pos], '\n') + 1
+	end := start
+	for end < len(w.src) && (w.src[end] == ' ' || w.src[end] == '\t') {
+		end += 1
+	}
+	return string(w.src[start:end])
+}
+
+func (w *syntaxWriter) writeFresh(value Value, prefix string, inline bool) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if !inline {
+		enc.SetIndent(prefix, w.indent)
+	}
+	err := enc.Encode(ToGo(value))
+	if err != nil {
+		panic(err.Error())
+	}
+	w.out.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// Whether the node is all on one line, in which case anything new in it should be too
+func (w *syntaxWriter) isInline(node *jsonSyntax) bool {
+	return w.indent == "" || bytes.IndexByte(w.src[node.start:node.end], '\n') < 0
+}
+
+// The separator to use after the first element of a container when there wasn't one
+func (w *syntaxWriter) firstSeparator(node *jsonSyntax, leading []byte) string {
+	if len(leading) == 0 && w.indent != "" {
+		return ", "
+	}
+	return "," + string(leading)
+}
+
+func (w *syntaxWriter) write(node *jsonSyntax, value Value, inline bool) {
+	if sameValue(node.value, value) {
+		w.out.Write(w.src[node.start:node.end])
+		return
+	}
+	switch value.(type) {
+		case ValueArray:
+			if len(node.elements) > 0 && len(value.(ValueArray)) > 0 {
+				w.writeArray(node, value.(ValueArray))
+				return
+			}
+		case ValueMap:
+			if len(node.members) > 0 && len(value.(ValueMap)) > 0 {
+				w.writeMap(node, value.(ValueMap))
+				return
+			}
+	}
+	w.writeFresh(value, w.lineIndent(node.start), inline)
+}
+
+func (w *syntaxWriter) writeMap(node *jsonSyntax, value ValueMap) {
+	members := node.members
+	inline := w.isInline(node)
+	separator := w.firstSeparator(node, w.src[node.start+1:members[0].start])
+	if len(members) > 1 {
+		separator = string(w.src[members[0].value.end:members[1].start])
+	}
+	w.out.Write(w.src[node.start:members[0].start])
+	first := true
+	for i, member := range members {
+		el, hasEl := value[member.key]
+		if !hasEl {
+			continue
+		}
+		if !first {
+			w.out.Write(w.src[members[i-1].value.end:member.start])
+		}
+		first = false
+		w.out.Write(w.src[member.start:member.value.start])
+		w.write(member.value, el, inline)
+	}
+	var added []string
+	for key := range value {
+		if node.value.(ValueMap)[key] == nil {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	colon := string(w.src[members[0].keyEnd:members[0].value.start])
+	prefix := w.lineIndent(members[0].start)
+	for _, key := range added {
+		if !first {
+			w.out.WriteString(separator)
+		}
+		first = false
+		keyJson, _ := json.Marshal(key)
+		w.out.Write(keyJson)
+		w.out.WriteString(colon)
+		w.writeFresh(value[key], prefix, inline)
+	}
+	last := members[len(members) - 1]
+	w.out.Write(w.src[last.value.end:node.end])
+}
+
+func (w *syntaxWriter) writeArray(node *jsonSyntax, value ValueArray) {
+	elements := node.elements
+	inline := w.isInline(node)
+	separator := w.firstSeparator(node, w.src[node.start+1:elements[0].start])
+	if len(elements) > 1 {
+		separator = string(w.src[elements[0].end:elements[1].start])
+	}
+	prefix := w.lineIndent(elements[0].start)
+	w.out.Write(w.src[node.start:elements[0].start])
+	// Line elements up with the originals, allowing for the ones that were deleted
+	removed := len(elements) - len(value)
+	i := 0
+	for j, el := range value {
+		if i < len(elements) && !sameValue(elements[i].value, el) {
+			for k := i + 1; k <= i + removed && k < len(elements); k += 1 {
+				if sameValue(elements[k].value, el) {
+					removed -= k - i
+					i = k
+					break
+				}
+			}
+		}
+		if i >= len(elements) {
+			w.out.WriteString(separator)
+			w.writeFresh(el, prefix, inline)
+			continue
+		}
+		if j != 0 {
+			if i == 0 {
+				w.out.WriteString(separator)
+			} else {
+				w.out.Write(w.src[elements[i-1].end:elements[i].start])
+			}
+		}
+		w.write(elements[i], el, inline)
+		i += 1
+	}
+	last := elements[len(elements) - 1]
+	w.out.Write(w.src[last.end:node.end])
+}
+
+// Writes the edited value of the document, keeping the formatting of
+// everything that is unchanged from the original
+func (doc *JsonDocument) Write(out io.Writer, value Value) (err error) {
+	defer recoverError(&err)
+	w := &syntaxWriter {
+		src: doc.src,
+		indent: guessIndent(doc.src),
+	}
+	w.out.Write(doc.src[:doc.root.start])
+	w.write(doc.root, value, w.indent == "")
+	w.out.Write(doc.src[doc.root.end:])
+	_, err = out.Write(w.out.Bytes())
+	return err
+}
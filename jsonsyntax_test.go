@@ -0,0 +1,132 @@
+package treek
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A copy of the map with key set to value, or removed if value is nil
+func withKey(m Value, key string, value Value) Value {
+	res := make(ValueMap)
+	for k, v := range m.(ValueMap) {
+		res[k] = v
+	}
+	if value == nil {
+		delete(res, key)
+	} else {
+		res[key] = value
+	}
+	return res
+}
+
+func withoutIndex(a Value, index int) Value {
+	res := ValueArray {}
+	res = append(res, a.(ValueArray)[:index]...)
+	return append(res, a.(ValueArray)[index + 1:]...)
+}
+
+func TestJsonDocument(t *testing.T) {
+	tests := []struct {
+		name string
+		src string
+		edit func(Value) Value
+		want string
+	}{
+		{
+			"unchanged",
+			"{\n  \"b\": [1,  2.50],\n  \"a\": {\"c\": true}\n}\n",
+			func(v Value) Value {return v},
+			"{\n  \"b\": [1,  2.50],\n  \"a\": {\"c\": true}\n}\n",
+		},
+		{
+			"changed value",
+			`{"a": 1.50,  "b": "x"}`,
+			func(v Value) Value {return withKey(v, "b", ValueString("y"))},
+			`{"a": 1.50,  "b": "y"}`,
+		},
+		{
+			"added keys inline",
+			`{"b": 1, "d": 2}`,
+			func(v Value) Value {return withKey(withKey(v, "c", ValueString("y")), "a", ValueString("x"))},
+			`{"b": 1, "d": 2, "a": "x", "c": "y"}`,
+		},
+		{
+			"added key multi-line",
+			"{\n  \"a\": 1\n}",
+			func(v Value) Value {return withKey(v, "b", ValueString("x"))},
+			"{\n  \"a\": 1,\n  \"b\": \"x\"\n}",
+		},
+		{
+			"removed key",
+			"{\n  \"a\": 1,\n  \"b\": 2,\n  \"c\": 3\n}",
+			func(v Value) Value {return withKey(v, "b", nil)},
+			"{\n  \"a\": 1,\n  \"c\": 3\n}",
+		},
+		{
+			"deleted middle element",
+			"[\n  1,\n  2,\n  3\n]",
+			func(v Value) Value {return withoutIndex(v, 1)},
+			"[\n  1,\n  3\n]",
+		},
+		{
+			"deleted first element",
+			"[\n  1,\n  2,\n  3\n]",
+			func(v Value) Value {return withoutIndex(v, 0)},
+			"[\n  2,\n  3\n]",
+		},
+		{
+			"deleted last element",
+			"[\n  1,\n  2,\n  3\n]",
+			func(v Value) Value {return withoutIndex(v, 2)},
+			"[\n  1,\n  2\n]",
+		},
+		{
+			"appended to an inline array",
+			"{\n  \"a\": [1, 2]\n}",
+			func(v Value) Value {
+				a := v.(ValueMap)["a"].(ValueArray)
+				return withKey(v, "a", append(append(ValueArray {}, a...), ValueString("x")))
+			},
+			"{\n  \"a\": [1, 2, \"x\"]\n}",
+		},
+		{
+			"new container multi-line",
+			"{\n  \"a\": 1\n}",
+			func(v Value) Value {return withKey(v, "a", ValueMap {"b": ValueString("c")})},
+			"{\n  \"a\": {\n    \"b\": \"c\"\n  }\n}",
+		},
+		{
+			"new container inline",
+			`{"a": 1, "b": 2}`,
+			func(v Value) Value {return withKey(v, "a", ValueArray {ValueString("x"), ValueString("y")})},
+			`{"a": ["x","y"], "b": 2}`,
+		},
+	}
+	for _, test := range tests {
+		doc, err := ReadJsonDocument([]byte(test.src))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var out bytes.Buffer
+		err = doc.Write(&out, test.edit(doc.Value()))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, out.String(), test.want)
+		}
+	}
+}
+
+// Line-delimited JSON would otherwise have everything after its first line
+// written back without being edited
+func TestJsonDocumentTrailingData(t *testing.T) {
+	_, err := ReadJsonDocument([]byte("{\"a\": 1}\n{\"a\": 2}\n"))
+	if err == nil {
+		t.Error("expected an error for data after the value")
+	}
+	_, err = ReadJsonDocument([]byte("{\"a\": 1}\n\n"))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,6 +1,7 @@
-package main
+package treek
 
 import (
+	"io"
 	"fmt"
 	"strings"
 	"unicode/utf8"
@@ -14,29 +15,39 @@ type lexer struct {
 	pos int
 	width int
 	nestingLevel int
-	tokenStream chan Token
+	state stateFunc
+	// Emitted but not yet taken by nextToken
+	tokens []Token
 }
 
-func (l *lexer) run() {
-	for state := lexBlockStart; state != nil; {
-		state = state(l)
+// Runs state functions until there is a token to hand out
+func (l *lexer) nextToken() Token {
+	for len(l.tokens) == 0 {
+		if l.state == nil {
+			return Token{typ: TokenEOF, pos: len(l.input)}
+		}
+		l.state = l.state(l)
 	}
-	close(l.tokenStream)
+	token := l.tokens[0]
+	l.tokens = l.tokens[1:]
+	return token
 }
 
 func (l *lexer) emit(t TokenType) {
-	l.tokenStream <- Token{
+	l.tokens = append(l.tokens, Token{
 		typ: t,
 		val: l.input[l.start:l.pos],
-	}
+		pos: l.start,
+	})
 	l.start = l.pos
 }
 
 func (l *lexer) errorf(format string, args ...interface{}) stateFunc {
-	l.tokenStream <- Token{
+	l.tokens = append(l.tokens, Token{
 		typ: TokenErr,
 		val: fmt.Sprintf(format, args...),
-	}
+		pos: l.start,
+	})
 	return nil
 }
 
@@ -131,11 +142,61 @@ const (
 	TokenEqual // ==
 	TokenNotEqual // !=
 	TokenNot // !
+	TokenComment // # to the end of the line
+	TokenColon // :
+	TokenDefault // ??
+	TokenSafeDot // ?.
 )
 
+var tokenNames = map[TokenType]string {
+	TokenErr: "Err",
+	TokenEOF: "EOF",
+	TokenNumber: "Number",
+	TokenIdentifier: "Identifier",
+	TokenAdd: "Add",
+	TokenSub: "Sub",
+	TokenAst: "Ast",
+	TokenDiv: "Div",
+	TokenDot: "Dot",
+	TokenComma: "Comma",
+	TokenSemicolon: "Semicolon",
+	TokenLParen: "LParen",
+	TokenRParen: "RParen",
+	TokenLBrace: "LBrace",
+	TokenRBrace: "RBrace",
+	TokenLBrack: "LBrack",
+	TokenRBrack: "RBrack",
+	TokenIndexPattern: "IndexPattern",
+	TokenAssign: "Assign",
+	TokenCircum: "Circum",
+	TokenDoubleQuote: "DoubleQuote",
+	TokenStringLiteral: "StringLiteral",
+	TokenAddAssign: "AddAssign",
+	TokenSubAssign: "SubAssign",
+	TokenAstAssign: "AstAssign",
+	TokenDivAssign: "DivAssign",
+	TokenEqual: "Equal",
+	TokenNotEqual: "NotEqual",
+	TokenNot: "Not",
+	TokenComment: "Comment",
+	TokenColon: "Colon",
+	TokenDefault: "Default",
+	TokenSafeDot: "SafeDot",
+}
+
+func (t TokenType) String() string {
+	name, hasName := tokenNames[t]
+	if !hasName {
+		return fmt.Sprintf("Token(%d)", int(t))
+	}
+	return name
+}
+
 type Token struct {
 	typ TokenType
 	val string
+	// Byte offset of the token in the program
+	pos int
 }
 
 func (t Token) String() string {
@@ -151,22 +212,51 @@ func (t Token) String() string {
 	return fmt.Sprintf("%q", t.val)
 }
 
-func Lex(input string) chan Token {
-	l := &lexer{
+// Where something is in a program
+type Position struct {
+	// Byte offset into the program, along with the line and column counting
+	// from 1
+	Pos, Line, Col int
+}
+
+func positionOf(input string, offset int) Position {
+	line, col := position(input, offset)
+	return Position {offset, line, col}
+}
+
+// Line and column, both counting from 1, of a byte offset into the program
+func position(input string, offset int) (line int, col int) {
+	before := input[:offset]
+	lineStart := strings.LastIndex(before, "\n") + 1
+	return strings.Count(before, "\n") + 1, utf8.RuneCountInString(before[lineStart:]) + 1
+}
+
+// Writes out every token the program lexes into, one per line
+func dumpTokens(input string, w io.Writer) {
+	l := lex(input)
+	for {
+		token := l.nextToken()
+		line, col := position(input, token.pos)
+		fmt.Fprintf(w, "%-8s%-16v%q\n", fmt.Sprintf("%v:%v", line, col), token.typ, token.val)
+		if token.typ == TokenEOF || token.typ == TokenErr {
+			return
+		}
+	}
+}
+
+func lex(input string) *lexer {
+	return &lexer{
 		input: input,
-		tokenStream: make(chan Token),
+		state: lexBlockStart,
 	}
-	go l.run()
-	return l.tokenStream
 }
 
 const (
-	whitespace string = " \t"
 	whitespaceNewlines string = " \t\r\n"
 )
 
 func isAlpha(r rune) bool {
-	return ('a' <= r && r < 'z') || ('A' <= r && r <= 'Z')
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
 }
 func isDigit(r rune) bool {
 	return '0' <= r && r <= '9'
@@ -181,9 +271,23 @@ func isIdentifierRune(r rune) bool {
 	return isIdentifierStartRune(r) || isDigit(r)
 }
 
+// Skips whitespace, emitting any comments along the way
+func (l *lexer) skipSpace() {
+	for {
+		l.acceptAll(whitespaceNewlines)
+		l.ignore()
+		if !l.accept("#") {
+			return
+		}
+		for r := l.peek(); r != '\n' && r != eof; r = l.peek() {
+			l.next()
+		}
+		l.emit(TokenComment)
+	}
+}
+
 func lexBlockStart(l *lexer) stateFunc {
-	l.acceptAll(whitespace)
-	l.ignore()
+	l.skipSpace()
 	if l.peek() == eof {
 		l.emit(TokenEOF)
 		return nil
@@ -236,14 +340,10 @@ func lexPatternEnd(l *lexer) stateFunc {
 		l.emit(TokenDot)
 		return lexPattern
 	}
-	l.acceptAll(whitespaceNewlines)
-	l.ignore()
+	l.skipSpace()
 	if !l.accept("{") {
-		if l.peek() == eof {
-			l.emit(TokenEOF)
-			return nil
-		}
-		return l.errorf("Missing Action")
+		// No action, so this is already the start of the next block
+		return lexBlockStart
 	}
 	l.emit(TokenLBrace)
 	l.nestingLevel += 1
@@ -258,40 +358,46 @@ func lexStartAction(l *lexer) stateFunc {
 	return lexBlockStart
 }
 
+var doubleCharTokens = map[rune]map[rune]TokenType{
+	'+': {
+		'=': TokenAddAssign,
+	},
+	'-': {
+		'=': TokenSubAssign,
+	},
+	'*': {
+		'=': TokenAstAssign,
+	},
+	'/': {
+		'=': TokenDivAssign,
+	},
+	'=': {
+		'=': TokenEqual,
+	},
+	'!': {
+		'=': TokenNotEqual,
+	},
+	'?': {
+		'?': TokenDefault,
+		'.': TokenSafeDot,
+	},
+}
+
+var charTokens = map[rune]TokenType{
+	'+': TokenAdd,
+	'-': TokenSub,
+	'/': TokenDiv,
+	'*': TokenAst,
+	'.': TokenDot,
+	',': TokenComma,
+	';': TokenSemicolon,
+	':': TokenColon,
+	'=': TokenAssign,
+	'!': TokenNot,
+}
+
 func lexAction(l *lexer) stateFunc {
-	l.acceptAll(whitespaceNewlines)
-	l.ignore()
-	doubleCharTokens := map[rune]map[rune]TokenType{
-		'+': {
-			'=': TokenAddAssign,
-		},
-		'-': {
-			'=': TokenSubAssign,
-		},
-		'*': {
-			'=': TokenAstAssign,
-		},
-		'/': {
-			'=': TokenDivAssign,
-		},
-		'=': {
-			'=': TokenEqual,
-		},
-		'!': {
-			'=': TokenNotEqual,
-		},
-	}
-	charTokens := map[rune]TokenType{
-		'+': TokenAdd,
-		'-': TokenSub,
-		'/': TokenDiv,
-		'*': TokenAst,
-		'.': TokenDot,
-		',': TokenComma,
-		';': TokenSemicolon,
-		'=': TokenAssign,
-		'!': TokenNot,
-	}
+	l.skipSpace()
 	r := l.next()
 	charToken, isCharToken := charTokens[r]
 	doubleCharMap, hasDoubleCharMap := doubleCharTokens[r]
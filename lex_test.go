@@ -0,0 +1,44 @@
+package treek
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A program of the sort people write, repeated to 200 blocks
+func benchmarkProgram() string {
+	var b strings.Builder
+	for i := 0; i < 50; i += 1 {
+		fmt.Fprintf(&b, "people.*.age {total%d += $0; count%d += 1}\n", i, i)
+		fmt.Fprintf(&b, "people.($0.last_name == \"Johnson%d\").first_name # comment\n", i)
+		fmt.Fprintf(&b, "^orders.*.items.* {$0.price = $0.price * 1.2; println($0.name + \" \" + $0.price)}\n")
+		fmt.Fprintf(&b, "people.*.password {delete}\n")
+	}
+	return b.String()
+}
+
+func BenchmarkLex(b *testing.B) {
+	src := benchmarkProgram()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		l := lex(src)
+		for {
+			token := l.nextToken()
+			if token.typ == TokenEOF || token.typ == TokenErr {
+				if token.typ == TokenErr {
+					b.Fatal(token.val)
+				}
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	src := benchmarkProgram()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		parse(lex(src), nil)
+	}
+}
@@ -0,0 +1,132 @@
+package treek
+
+import (
+	"io"
+	"errors"
+)
+
+var (
+	ErrInstructionLimit = errors.New("treek: instruction limit exceeded")
+	ErrAllocationLimit = errors.New("treek: allocation limit exceeded")
+	ErrOutputLimit = errors.New("treek: output limit exceeded")
+)
+
+// Bounds on how much work a run of a program can do, for running programs
+// that can't be trusted. Zero means no limit. When running records in
+// parallel the instruction and allocation limits apply to each record.
+type Limits struct {
+	// Instructions executed by actions and filters
+	Instructions int
+	// Rough number of bytes of values created by the program. This counts
+	// everything ever created rather than what is still in use.
+	Allocation int
+	// Bytes written to the output
+	Output int
+}
+
+// Rough size of a value, not counting anything it shares with other values
+func sizeOf(value Value) int {
+	switch value.(type) {
+		case ValueString:
+			return 16 + len(value.(ValueString))
+		case ValueArray:
+			return 24 + 16 * len(value.(ValueArray))
+		case ValueMap:
+			return 48 + 64 * len(value.(ValueMap))
+		case ValueNumber:
+			number := value.(ValueNumber)
+			if number.big != nil {
+				return 16 + number.big.BitLen() / 8
+			} else if number.decimal != nil {
+				return 16 + (number.decimal.Num().BitLen() + number.decimal.Denom().BitLen()) / 8
+			}
+			return 16
+		default:
+			return 16
+	}
+}
+
+func (state *EvalState) step(n int) {
+	if state.limits.Instructions == 0 {
+		return
+	}
+	state.instructions += n
+	if state.instructions > state.limits.Instructions {
+		panic(ErrInstructionLimit)
+	}
+}
+
+func (state *EvalState) allocate(n int) {
+	if state.limits.Allocation == 0 {
+		return
+	}
+	state.allocated += n
+	if state.allocated > state.limits.Allocation {
+		panic(ErrAllocationLimit)
+	}
+}
+
+// Counts a value being written into root at path, which copies every
+// container along the way
+func (state *EvalState) allocateAssignment(root Value, path []Value, value Value) {
+	if state.limits.Allocation == 0 {
+		return
+	}
+	for _, segment := range path {
+		state.allocate(sizeOf(root))
+		root = root.index(segment)
+	}
+	state.allocate(sizeOf(value))
+}
+
+// Some arithmetic can make something enormous out of something tiny, like
+// repeating a string or array, or using a number as an array of that many
+// nulls, so it's checked before the result is built rather than after
+func (state *EvalState) checkGrowth(op InstructionBasic, l Value, r Value) {
+	if state.limits.Allocation == 0 {
+		return
+	}
+	n, rIsNumber := r.(ValueNumber)
+	size := 0.0
+	switch l.(type) {
+		case ValueString:
+			if op == InstructionMul {
+				size = float64(sizeOf(l)) * float64(r.castToNumber().toInt())
+			}
+		case ValueArray:
+			if op == InstructionMul {
+				size = float64(sizeOf(l)) * float64(r.castToNumber().toInt())
+			} else if rIsNumber && op != InstructionSub {
+				// Adding casts the number to an array and dividing makes
+				// that many parts
+				size = 24 * float64(n.toInt())
+			}
+		case ValueMap:
+			if rIsNumber && (op == InstructionSub || op == InstructionDiv) {
+				size = 16 * float64(n.toInt())
+			}
+	}
+	if float64(state.allocated) + size > float64(state.limits.Allocation) {
+		panic(ErrAllocationLimit)
+	}
+}
+
+type limitedWriter struct {
+	out io.Writer
+	remaining int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.remaining {
+		panic(ErrOutputLimit)
+	}
+	w.remaining -= len(p)
+	return w.out.Write(p)
+}
+
+func limitOutput(out io.Writer, limits Limits) io.Writer {
+	if limits.Output == 0 {
+		return out
+	}
+	return &limitedWriter {out, limits.Output}
+}
@@ -0,0 +1,69 @@
+package treek
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func limitsData() Value {
+	return ValueMap {
+		"a": ValueArray {intNumber(1), intNumber(2)},
+		"s": ValueString("ab"),
+		"m": ValueMap {"k": intNumber(1)},
+	}
+}
+
+func runLimited(src string, limits Limits) error {
+	program, err := Compile(src)
+	if err != nil {
+		return err
+	}
+	program.Limits = limits
+	_, err = program.RunValue(context.Background(), limitsData(), io.Discard)
+	return err
+}
+
+func TestInstructionLimit(t *testing.T) {
+	err := runLimited(`a.* {x = $0 + 1; y = x * 2}`, Limits {Instructions: 5})
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Errorf("got %v, want the instruction limit", err)
+	}
+	err = runLimited(`a.* {x = $0 + 1; y = x * 2}`, Limits {Instructions: 1000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	err := runLimited(`a.* {println("hello")}`, Limits {Output: 8})
+	if !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("got %v, want the output limit", err)
+	}
+}
+
+func TestAllocationLimit(t *testing.T) {
+	tests := []string {
+		`a {x = $0 * 100000000}`,
+		`s {x = $0 * 100000000}`,
+		`a {x = $0 + 50000000}`,
+		`a {x = $0 / 100000000}`,
+		`m {x = $0 - 100000000}`,
+		`m {x = $0 / 100000000}`,
+	}
+	for _, src := range tests {
+		err := runLimited(src, Limits {Allocation: 1 << 20})
+		if !errors.Is(err, ErrAllocationLimit) {
+			t.Errorf("%s: got %v, want the allocation limit", src, err)
+		}
+	}
+}
+
+func TestArrayDivideByZero(t *testing.T) {
+	err := runLimited(`a {x = $0 / 0}`, Limits {})
+	if err == nil || !strings.Contains(err.Error(), "positive number of parts") {
+		t.Errorf("got %v, want an error about the number of parts", err)
+	}
+}
@@ -0,0 +1,533 @@
+package treek
+
+import (
+	"io"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// A problem found in a program by Lint
+type Diagnostic struct {
+	Position
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%v:%v: %v", d.Line, d.Col, d.Message)
+}
+
+const typeUnknown ValueType = -1
+
+// What the linter knows about a value an instruction would leave on the stack
+type lintValue struct {
+	// The variable it is, or is inside of
+	variable string
+	pos int
+	indexed bool
+	typ ValueType
+	// For string literals, which might be used as an index
+	str string
+	isStr bool
+	// When it comes from indexing into $0, the keys used and where
+	fromNode bool
+	keys []string
+	keyPositions []int
+}
+
+type linter struct {
+	program Program
+	functions *Functions
+	sample Value
+	diagnostics []Diagnostic
+	reported map[Diagnostic]bool
+
+	// Where each variable is first read and first assigned
+	reads map[string]int
+	assigns map[string]int
+
+	stack []lintValue
+	// Sample nodes the expression being checked might have as $0
+	nodes []Value
+}
+
+func (l *linter) report(pos int, format string, args ...interface{}) {
+	diagnostic := Diagnostic {positionOf(l.program.src, pos), fmt.Sprintf(format, args...)}
+	if l.reported[diagnostic] {
+		return
+	}
+	l.reported[diagnostic] = true
+	l.diagnostics = append(l.diagnostics, diagnostic)
+}
+
+func (l *linter) push(value lintValue) {
+	l.stack = append(l.stack, value)
+}
+
+func (l *linter) pop() lintValue {
+	value := l.stack[len(l.stack) - 1]
+	l.stack = l.stack[:len(l.stack) - 1]
+	return value
+}
+
+// Pops a value that is used, rather than assigned to
+func (l *linter) read() lintValue {
+	value := l.pop()
+	if value.variable != "" {
+		if _, hasRead := l.reads[value.variable]; !hasRead {
+			l.reads[value.variable] = value.pos
+		}
+	}
+	if value.fromNode && len(value.keys) > 0 && l.sample != nil && len(l.nodes) > 0 {
+		l.checkKeys(value)
+	}
+	return value
+}
+
+// Reports the first key of $0.a.b... that none of the sample nodes have
+func (l *linter) checkKeys(value lintValue) {
+	nodes := l.nodes
+	for i, key := range value.keys {
+		var children []Value
+		for _, node := range nodes {
+			child, hasChild := sampleChild(node, key)
+			if hasChild {
+				children = append(children, child)
+			}
+		}
+		if len(children) == 0 {
+			l.report(value.keyPositions[i], "No %q at any node in the sample this could be", key)
+			return
+		}
+		nodes = children
+	}
+}
+
+func sampleChild(node Value, key string) (Value, bool) {
+	switch node.(type) {
+		case ValueMap:
+			child, hasChild := node.(ValueMap)[key]
+			return child, hasChild
+		case ValueArray:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node.(ValueArray)) {
+				return nil, false
+			}
+			return node.(ValueArray)[index], true
+	}
+	return nil, false
+}
+
+func sampleChildren(node Value) []Value {
+	switch node.(type) {
+		case ValueMap:
+			var children []Value
+			for _, child := range node.(ValueMap) {
+				children = append(children, child)
+			}
+			return children
+		case ValueArray:
+			return node.(ValueArray)
+	}
+	return nil
+}
+
+func (l *linter) assign(target lintValue, pos int) {
+	if target.variable == "" {
+		return
+	}
+	if _, hasAssign := l.assigns[target.variable]; !hasAssign {
+		l.assigns[target.variable] = target.pos
+	}
+	if target.indexed {
+		// Assigning into x.y keeps the rest of x, so x is used too
+		if _, hasRead := l.reads[target.variable]; !hasRead {
+			l.reads[target.variable] = target.pos
+		}
+	}
+}
+
+// What each subroutine returns
+var subroutineTypes = map[Subroutine]ValueType {
+	SubroutinePrintln: TypeNull,
+	SubroutineNum: TypeNumber,
+	SubroutineStr: TypeString,
+	SubroutineBool: TypeBool,
+	SubroutineTypeof: TypeString,
+}
+
+var arithmeticNames = map[InstructionBasic]string {
+	InstructionAdd: "Addition",
+	InstructionSub: "Subtraction",
+	InstructionMul: "Multiplication",
+	InstructionDiv: "Division",
+}
+
+// The type arithmetic converts its right hand side to, given its left
+func operandType(op InstructionBasic, lhs ValueType) ValueType {
+	switch {
+		case lhs == TypeString && op == InstructionMul:
+			return TypeNumber
+		case lhs == TypeArray && op != InstructionAdd:
+			return TypeNumber
+		case lhs == TypeMap && (op == InstructionSub || op == InstructionDiv):
+			return TypeArray
+	}
+	return lhs
+}
+
+// Arithmetic converts its right hand side to whatever its left hand side
+// works with, which is rarely what was meant when both types are known and
+// that isn't already what the right hand side is
+func (l *linter) arithmetic(op InstructionBasic, pos int) {
+	rhs := l.read()
+	lhs := l.read()
+	// Adding anything to a string is the usual way to build one up
+	isConcatenation := op == InstructionAdd && lhs.typ == TypeString
+	if lhs.typ != typeUnknown && rhs.typ != typeUnknown && lhs.typ != TypeNull && rhs.typ != TypeNull && !isConcatenation {
+		expected := operandType(op, lhs.typ)
+		// Some right hand sides work as they are, like a map of the keys to
+		// split another map by
+		isAllowed := strictOperands[op][typePair {lhs.typ, rhs.typ}]
+		if rhs.typ != expected && !isAllowed {
+			l.report(pos, "%s of %s and %s converts the latter to %s", arithmeticNames[op], typeNameInSentence(lhs.typ), typeNameInSentence(rhs.typ), typeNameInSentence(expected))
+		}
+	}
+	typ := lhs.typ
+	if typ == TypeNull {
+		typ = rhs.typ
+	}
+	if op == InstructionDiv && (typ == TypeString || typ == TypeMap) {
+		// Splitting gives an array of the parts
+		typ = TypeArray
+	}
+	l.push(lintValue {typ: typ})
+}
+
+func (l *linter) track(instruction Instruction, pos int) {
+	switch instruction.(type) {
+		case InstructionPushVariable:
+			variable := string(instruction.(InstructionPushVariable))
+			value := lintValue {variable: variable, pos: pos, typ: typeUnknown}
+			if variable == "$0" {
+				value.fromNode = true
+			} else if variable == "path" {
+				value.typ = TypeArray
+			}
+			l.push(value)
+		case InstructionPushNumber:
+			l.push(lintValue {typ: TypeNumber})
+		case InstructionPushString:
+			l.push(lintValue {typ: TypeString, str: string(instruction.(InstructionPushString)), isStr: true})
+		case InstructionCall:
+			for i := 0; i < instruction.(InstructionCall).nargs; i += 1 {
+				l.read()
+			}
+			l.push(lintValue {typ: subroutineTypes[instruction.(InstructionCall).subroutine]})
+		case InstructionTry:
+			try := instruction.(InstructionTry)
+			l.nested(try.body)
+			if try.variable != "" {
+				l.assign(lintValue {variable: try.variable, pos: pos}, pos)
+			}
+			l.nested(try.handler)
+			l.push(lintValue {typ: typeUnknown})
+		case InstructionCallHost:
+			call := instruction.(InstructionCallHost)
+			fn, isHost := l.functions.lookup(call.name)
+			if !isHost {
+				l.report(pos, "Unknown function %s", call.name)
+			} else if fn.nargs >= 0 && fn.nargs != call.nargs {
+				l.report(pos, "%s takes %v arguments but was called with %v", call.name, fn.nargs, call.nargs)
+			}
+			for i := 0; i < call.nargs; i += 1 {
+				l.read()
+			}
+			l.push(lintValue {typ: typeUnknown})
+		case InstructionBasic:
+			switch instruction.(InstructionBasic) {
+				case InstructionAdd, InstructionSub, InstructionMul, InstructionDiv:
+					l.arithmetic(instruction.(InstructionBasic), pos)
+				case InstructionEqual, InstructionIn:
+					l.read()
+					l.read()
+					l.push(lintValue {typ: TypeBool})
+				case InstructionDefault:
+					rhs := l.read()
+					lhs := l.read()
+					typ := lhs.typ
+					if typ == TypeNull {
+						typ = rhs.typ
+					} else if typ != rhs.typ {
+						typ = typeUnknown
+					}
+					l.push(lintValue {typ: typ})
+				case InstructionSafeIndex:
+					index := l.read()
+					parent := l.read()
+					value := lintValue {typ: typeUnknown}
+					if parent.fromNode && index.isStr {
+						value.fromNode = true
+						value.keys = append(append([]string{}, parent.keys...), index.str)
+						value.keyPositions = append(append([]int{}, parent.keyPositions...), pos)
+					}
+					l.push(value)
+				case InstructionNot:
+					l.read()
+					l.push(lintValue {typ: TypeBool})
+				case InstructionIgnore:
+					l.read()
+				case InstructionPushNull:
+					l.push(lintValue {typ: TypeNull})
+				case InstructionAssign:
+					l.read()
+					l.assign(l.pop(), pos)
+					l.push(lintValue {typ: TypeNull})
+				case InstructionIndex:
+					index := l.read()
+					parent := l.pop()
+					value := lintValue {
+						variable: parent.variable,
+						pos: parent.pos,
+						indexed: parent.variable != "",
+						typ: typeUnknown,
+					}
+					if parent.fromNode && index.isStr {
+						value.fromNode = true
+						value.keys = append(append([]string{}, parent.keys...), index.str)
+						value.keyPositions = append(append([]int{}, parent.keyPositions...), pos)
+					}
+					l.push(value)
+				case InstructionSlice:
+					l.read()
+					l.read()
+					l.push(lintValue {typ: l.read().typ})
+				case InstructionDup:
+					value := l.pop()
+					l.push(value)
+					l.push(value)
+				case InstructionDelete:
+					l.assign(l.pop(), pos)
+					l.push(lintValue {typ: TypeNull})
+			}
+	}
+}
+
+func (l *linter) expression(expr Expression, nodes []Value) {
+	l.stack = nil
+	l.nodes = nodes
+	l.nested(expr)
+}
+
+func (l *linter) nested(expr Expression) {
+	for i, instruction := range expr.instructions {
+		l.track(instruction, expr.positions[i])
+	}
+	l.read()
+}
+
+// Whether a filter never looks at anything that could change, so it either
+// always passes or never does
+func isConstant(expr Expression) bool {
+	for _, instruction := range expr.flatten() {
+		switch instruction.(type) {
+			case InstructionPushVariable, InstructionCall, InstructionCallHost:
+				return false
+		}
+	}
+	return true
+}
+
+// How many entries an instruction takes off the stack and how many it leaves
+func stackEffect(instruction Instruction) (int, int) {
+	switch instruction.(type) {
+		case InstructionCall:
+			return instruction.(InstructionCall).nargs, 1
+		case InstructionCallHost:
+			return instruction.(InstructionCallHost).nargs, 1
+		case InstructionBasic:
+			switch instruction.(InstructionBasic) {
+				case InstructionPushNull:
+					return 0, 1
+				case InstructionIgnore:
+					return 1, 0
+				case InstructionNot, InstructionDelete:
+					return 1, 1
+				case InstructionDup:
+					return 1, 2
+				case InstructionSlice:
+					return 3, 1
+				default:
+					return 2, 1
+			}
+		default:
+			return 0, 1
+	}
+}
+
+// Whether an action always deletes $0, so nothing else will see the node.
+// Deletes on the right of ?? or in a try might not run, so they don't count.
+func deletesNode(expr Expression) bool {
+	// Whether working out each entry on the stack deletes $0
+	var stack []bool
+	deletes := false
+	for i, instruction := range expr.instructions {
+		pops, pushes := stackEffect(instruction)
+		popped := stack[len(stack) - pops:]
+		stack = stack[:len(stack) - pops]
+		var result bool
+		for _, entry := range popped {
+			result = result || entry
+		}
+		switch instruction {
+			case InstructionDefault:
+				result = popped[0]
+			case InstructionDelete:
+				variable, isVariable := expr.instructions[i - 1].(InstructionPushVariable)
+				result = result || isVariable && variable == "$0"
+			case InstructionIgnore:
+				deletes = deletes || result
+		}
+		for j := 0; j < pushes; j += 1 {
+			stack = append(stack, result && j == 0)
+		}
+	}
+	for _, entry := range stack {
+		deletes = deletes || entry
+	}
+	return deletes
+}
+
+// Whether every node the pattern of b matches has an ancestor, or is itself
+// a node, that a matches, and a has no filters
+func coversPrefix(a Pattern, b Pattern) bool {
+	if len(a.segments) > len(b.segments) {
+		return false
+	}
+	for i, segment := range a.segments {
+		switch segment.(type) {
+			case PatternSegmentBasic:
+			case PatternSegmentIndex:
+				if b.segments[i] != segment {
+					return false
+				}
+			default:
+				return false
+		}
+	}
+	return true
+}
+
+func (l *linter) unreachable() {
+	for i, a := range l.program.blocks {
+		if !deletesNode(a.action) {
+			continue
+		}
+		for j, b := range l.program.blocks {
+			if i == j || !coversPrefix(a.pattern, b.pattern) {
+				continue
+			}
+			var after bool
+			if len(b.pattern.segments) > len(a.pattern.segments) {
+				// Deleted on the way down before any descendants are visited
+				after = a.pattern.isFirst
+			} else {
+				after = a.pattern.isFirst == b.pattern.isFirst && j > i || a.pattern.isFirst && !b.pattern.isFirst
+			}
+			if after {
+				line, col := position(l.program.src, a.pos)
+				l.report(b.pos, "Never runs, block at %v:%v deletes every node it would match first", line, col)
+			}
+		}
+	}
+}
+
+// Runs a filter that doesn't depend on anything to see which way it goes,
+// or how it fails
+func constantResult(filter PatternSegmentFilter) (result bool, err error) {
+	defer recoverError(&err)
+	state := newEvalState(context.Background(), Program {}, nil, io.Discard)
+	return bool(filter.compiled(state).castToBool()), nil
+}
+
+func (l *linter) block(block Block) {
+	nodes := []Value {l.sample}
+	for i, segment := range block.pattern.segments {
+		pos := block.pattern.positions[i]
+		var next []Value
+		for _, node := range nodes {
+			switch segment.(type) {
+				case PatternSegmentIndex:
+					child, hasChild := sampleChild(node, string(segment.(PatternSegmentIndex)))
+					if hasChild {
+						next = append(next, child)
+					}
+				default:
+					next = append(next, sampleChildren(node)...)
+			}
+		}
+		if l.sample != nil && len(nodes) > 0 && len(next) == 0 {
+			l.report(pos, "Matches nothing in the sample")
+		}
+		nodes = next
+		filter, isFilter := segment.(PatternSegmentFilter)
+		if !isFilter {
+			continue
+		}
+		if isConstant(filter.expr) {
+			result, err := constantResult(filter)
+			var runtimeErr *RuntimeError
+			if errors.As(err, &runtimeErr) {
+				l.report(pos, "Filter always fails: %s", runtimeErr.Message)
+			} else if err != nil {
+				l.report(pos, "Filter always fails: %v", err)
+			} else if result {
+				l.report(pos, "Filter is always true, * would do the same")
+			} else {
+				l.report(pos, "Filter is never true, so the block never runs")
+			}
+		}
+		l.expression(filter.expr, nodes)
+	}
+	if !block.action.empty() {
+		l.expression(block.action, nodes)
+	}
+}
+
+// Looks for likely mistakes in a program: variables that are read but never
+// assigned or assigned but never read, blocks that can never run, calls to
+// functions that don't exist or with the wrong number of arguments, and
+// arithmetic between types that don't go together. Given a sample document it
+// also reports pattern segments and keys of $0 that match nothing in it.
+// The error is for programs that don't parse.
+func Lint(program string, functions *Functions, sample Value) (diagnostics []Diagnostic, err error) {
+	defer recoverError(&err)
+	l := &linter {
+		program: parse(lex(program), anyFunctions),
+		functions: functions,
+		sample: sample,
+		reported: make(map[Diagnostic]bool),
+		reads: make(map[string]int),
+		assigns: make(map[string]int),
+	}
+	for _, block := range l.program.blocks {
+		l.block(block)
+	}
+	l.unreachable()
+	for variable, pos := range l.reads {
+		if _, isAssigned := l.assigns[variable]; !isAssigned && variable != "$0" && variable != "path" {
+			l.report(pos, "%s is never assigned, so it's always null", variable)
+		}
+	}
+	for variable, pos := range l.assigns {
+		if _, isRead := l.reads[variable]; !isRead && variable != "$0" && variable != "path" {
+			l.report(pos, "%s is assigned but never used", variable)
+		}
+	}
+	sort.Slice(l.diagnostics, func(i, j int) bool {
+		return l.diagnostics[i].Pos < l.diagnostics[j].Pos
+	})
+	return l.diagnostics, nil
+}
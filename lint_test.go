@@ -0,0 +1,67 @@
+package treek
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		src string
+		want []string
+	}{
+		{`{x = 1; println(x)}`, nil},
+		{`people.* {unused = 1}`, []string {"1:11: unused is assigned but never used"}},
+		{`people.*.name {println(name)}`, []string {"1:24: name is never assigned, so it's always null"}},
+		{`{x = "a" * "b"; println(x)}`, []string {"1:10: Multiplication of a string and a string converts the latter to a number"}},
+		{`^people.* {delete} people.*.age {println($0)}`, []string {"1:20: Never runs, block at 1:1 deletes every node it would match first"}},
+		{`^people.* {$0.keep ?? delete} people.*.name {println($0)}`, nil},
+		{`^people.* {try {delete} catch (e) {println(e)}} people.*.name {println($0)}`, nil},
+		{`^people.* {x = 1; delete; println(x)} people.*.age {println($0)}`, []string {"1:39: Never runs, block at 1:1 deletes every node it would match first"}},
+		{`people.(1 == 1).name {println($0)}`, []string {"1:8: Filter is always true, * would do the same"}},
+		{`people.(1 == 2).name {println($0)}`, []string {"1:8: Filter is never true, so the block never runs"}},
+		{`people.(1 / 0) {println($0)}`, []string {"1:8: Filter always fails: Division by zero"}},
+		{`{println(lookup(1))}`, []string {"1:10: Unknown function lookup"}},
+	}
+	for _, test := range tests {
+		diagnostics, err := Lint(test.src, nil, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		var got []string
+		for _, diagnostic := range diagnostics {
+			got = append(got, diagnostic.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+func TestLintArithmetic(t *testing.T) {
+	tests := []struct {
+		op InstructionBasic
+		lhs, rhs ValueType
+		warns bool
+	}{
+		{InstructionDiv, TypeMap, TypeMap, false},
+		{InstructionDiv, TypeMap, TypeArray, false},
+		{InstructionSub, TypeMap, TypeArray, false},
+		{InstructionDiv, TypeString, TypeString, false},
+		{InstructionDiv, TypeMap, TypeNumber, true},
+		{InstructionSub, TypeArray, TypeString, true},
+	}
+	for _, test := range tests {
+		l := &linter {
+			reported: make(map[Diagnostic]bool),
+			reads: make(map[string]int),
+		}
+		l.push(lintValue {typ: test.lhs})
+		l.push(lintValue {typ: test.rhs})
+		l.arithmetic(test.op, 0)
+		if warns := len(l.diagnostics) > 0; warns != test.warns {
+			t.Errorf("%s of %s and %s: got %v, want a warning: %v", arithmeticNames[test.op], typeNames[test.lhs], typeNames[test.rhs], l.diagnostics, test.warns)
+		}
+	}
+}
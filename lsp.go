@@ -0,0 +1,502 @@
+package treek
+
+import (
+	"io"
+	"bufio"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"encoding/json"
+)
+
+// Language server protocol over stdio, for editor support of treek programs
+
+type lspRequest struct {
+	ID *json.RawMessage `json:"id"`
+	Method string `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID *json.RawMessage `json:"id"`
+	Result interface{} `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID *json.RawMessage `json:"id"`
+	Error lspError `json:"error"`
+}
+
+type lspError struct {
+	Code int `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method string `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type lspPosition struct {
+	Line int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range lspRange `json:"range"`
+	Severity int `json:"severity"`
+	Source string `json:"source"`
+	Message string `json:"message"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+const (
+	lspSeverityError = 1
+	lspSeverityWarning = 2
+	lspMethodNotFound = -32601
+	lspInvalidParams = -32602
+)
+
+type lspBuiltin struct {
+	kind int
+	signature string
+	doc string
+}
+
+// Completion item kinds
+const (
+	lspKindFunction = 3
+	lspKindVariable = 6
+	lspKindKeyword = 14
+)
+
+var lspBuiltins = map[string]lspBuiltin {
+	"println": {lspKindFunction, "println(values...)", "Prints each value on one line, separated by spaces."},
+	"num": {lspKindFunction, "num(x)", "Converts x to a number."},
+	"str": {lspKindFunction, "str(x)", "Converts x to a string."},
+	"bool": {lspKindFunction, "bool(x)", "Converts x to true or false."},
+	"typeof": {lspKindFunction, "typeof(x)", "The type of x, one of \"null\", \"bool\", \"number\", \"string\", \"array\" or \"map\"."},
+	"try": {lspKindKeyword, "try {body} catch (e) {handler}", "Runs body, and if it fails runs handler instead with the error in e. e is what was passed to error(), or a message saying what went wrong. (e) can be left out."},
+	"catch": {lspKindKeyword, "try {body} catch (e) {handler}", "Runs body, and if it fails runs handler instead with the error in e. e is what was passed to error(), or a message saying what went wrong. (e) can be left out."},
+	"error": {lspKindFunction, "error(value)", "Fails with value, which a catch gets as its error."},
+	"eprintln": {lspKindFunction, "eprintln(values...)", "Prints each value on one line, separated by spaces, to stderr."},
+	"delete": {lspKindKeyword, "delete or delete(x)", "Removes x, or the current node if there is no x, from the variable or document it is in."},
+	"$0": {lspKindVariable, "$0", "The node the block matched. Assigning to it or into it edits the document."},
+	"in": {lspKindKeyword, "key in x", "Whether the map x has the key, or the array or string x has the index, so a missing key can be told apart from one that's null."},
+	"path": {lspKindVariable, "path", "The keys and indices leading from the root to $0."},
+}
+
+type lspServer struct {
+	in *bufio.Reader
+	out io.Writer
+	docs map[string]string
+}
+
+func (s *lspServer) read() (lspRequest, error) {
+	var request lspRequest
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return request, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, hasValue := strings.Cut(line, ":")
+		if hasValue && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return request, err
+			}
+		}
+	}
+	if length < 0 {
+		return request, errors.New("Missing Content-Length header")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	if err != nil {
+		return request, err
+	}
+	return request, json.Unmarshal(body, &request)
+}
+
+func (s *lspServer) write(message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// Converts a byte offset into the line and UTF-16 character the protocol
+// counts positions in
+func lspOffsetPosition(src string, offset int) lspPosition {
+	before := src[:offset]
+	lineStart := strings.LastIndex(before, "\n") + 1
+	character := 0
+	for _, r := range before[lineStart:] {
+		character += utf16Length(r)
+	}
+	return lspPosition {strings.Count(before, "\n"), character}
+}
+
+func lspPositionOffset(src string, position lspPosition) int {
+	offset := 0
+	for line := 0; line < position.Line; line += 1 {
+		newline := strings.IndexByte(src[offset:], '\n')
+		if newline < 0 {
+			return len(src)
+		}
+		offset += newline + 1
+	}
+	for character := 0; character < position.Character && offset < len(src); {
+		r, width := utf8.DecodeRuneInString(src[offset:])
+		if r == '\n' {
+			break
+		}
+		character += utf16Length(r)
+		offset += width
+	}
+	return offset
+}
+
+func utf16Length(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+func (s *lspServer) rangeOf(src string, start int, length int) lspRange {
+	return lspRange {lspOffsetPosition(src, start), lspOffsetPosition(src, start + length)}
+}
+
+// Lexes as much of the program as it can, which is all editor features need
+// when it's half written
+func lexAll(src string) []Token {
+	var tokens []Token
+	l := lex(src)
+	for {
+		token := l.nextToken()
+		if token.typ == TokenEOF || token.typ == TokenErr {
+			return tokens
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+// The identifier at an offset, if it's a variable or a builtin rather than
+// a key after a dot
+func identifierAt(tokens []Token, offset int) (Token, int, bool) {
+	for i, token := range tokens {
+		if token.typ != TokenIdentifier || offset < token.pos || offset > token.pos + len(token.val) {
+			continue
+		}
+		if i > 0 && tokens[i - 1].typ == TokenDot {
+			return token, i, false
+		}
+		return token, i, true
+	}
+	return Token {}, 0, false
+}
+
+func isAssignToken(typ TokenType) bool {
+	_, isAssign := assigns[typ]
+	return isAssign || typ == TokenAssign
+}
+
+func (s *lspServer) diagnostics(uri string) error {
+	src := s.docs[uri]
+	diagnostics := []lspDiagnostic {}
+	found, err := Lint(src, nil, nil)
+	// Whatever stopped the lint is shown in the editor rather than ending
+	// the server, at the start of the program if it has no position
+	var syntaxErr *SyntaxError
+	var runtimeErr *RuntimeError
+	if errors.As(err, &syntaxErr) {
+		diagnostics = append(diagnostics, lspDiagnostic {
+			Range: s.rangeOf(src, syntaxErr.Pos, 0),
+			Severity: lspSeverityError,
+			Source: "treek",
+			Message: syntaxErr.Message,
+		})
+	} else if errors.As(err, &runtimeErr) {
+		diagnostics = append(diagnostics, lspDiagnostic {
+			Range: s.rangeOf(src, runtimeErr.Pos, 0),
+			Severity: lspSeverityError,
+			Source: "treek",
+			Message: runtimeErr.Message,
+		})
+	} else if err != nil {
+		diagnostics = append(diagnostics, lspDiagnostic {
+			Range: s.rangeOf(src, 0, 0),
+			Severity: lspSeverityError,
+			Source: "treek",
+			Message: err.Error(),
+		})
+	}
+	tokens := lexAll(src)
+	for _, diagnostic := range found {
+		length := 0
+		if token, _, isIdentifier := identifierAt(tokens, diagnostic.Pos); isIdentifier && token.pos == diagnostic.Pos {
+			length = len(token.val)
+		}
+		diagnostics = append(diagnostics, lspDiagnostic {
+			Range: s.rangeOf(src, diagnostic.Pos, length),
+			Severity: lspSeverityWarning,
+			Source: "treek",
+			Message: diagnostic.Message,
+		})
+	}
+	return s.write(lspNotification {
+		JSONRPC: "2.0",
+		Method: "textDocument/publishDiagnostics",
+		Params: map[string]interface{} {
+			"uri": uri,
+			"diagnostics": diagnostics,
+		},
+	})
+}
+
+func (s *lspServer) hover(params lspTextDocumentPosition) interface{} {
+	src := s.docs[params.TextDocument.URI]
+	tokens := lexAll(src)
+	token, _, isIdentifier := identifierAt(tokens, lspPositionOffset(src, params.Position))
+	if !isIdentifier {
+		return nil
+	}
+	builtin, isBuiltin := lspBuiltins[token.val]
+	if !isBuiltin {
+		return nil
+	}
+	return map[string]interface{} {
+		"contents": map[string]string {
+			"kind": "markdown",
+			"value": fmt.Sprintf("```\n%s\n```\n%s", builtin.signature, builtin.doc),
+		},
+		"range": s.rangeOf(src, token.pos, len(token.val)),
+	}
+}
+
+func (s *lspServer) completion(params lspTextDocumentPosition) interface{} {
+	src := s.docs[params.TextDocument.URI]
+	offset := lspPositionOffset(src, params.Position)
+	tokens := lexAll(src[:offset])
+	if len(tokens) > 0 {
+		last := tokens[len(tokens) - 1]
+		afterDot := last.typ == TokenDot ||
+			last.typ == TokenIdentifier && len(tokens) > 1 && tokens[len(tokens) - 2].typ == TokenDot
+		if afterDot {
+			// Keys depend on the document, which we don't have
+			return []interface{} {}
+		}
+	}
+	items := []map[string]interface{} {}
+	seen := make(map[string]bool)
+	var names []string
+	for name := range lspBuiltins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		builtin := lspBuiltins[name]
+		seen[name] = true
+		items = append(items, map[string]interface{} {
+			"label": name,
+			"kind": builtin.kind,
+			"detail": builtin.signature,
+			"documentation": builtin.doc,
+		})
+	}
+	all := lexAll(src)
+	for i, token := range all {
+		if token.typ != TokenIdentifier || seen[token.val] || i > 0 && all[i - 1].typ == TokenDot {
+			continue
+		}
+		if offset >= token.pos && offset <= token.pos + len(token.val) {
+			// What's being typed
+			continue
+		}
+		seen[token.val] = true
+		items = append(items, map[string]interface{} {
+			"label": token.val,
+			"kind": lspKindVariable,
+		})
+	}
+	return items
+}
+
+// Variables are defined where they are first assigned
+func (s *lspServer) definition(params lspTextDocumentPosition) interface{} {
+	uri := params.TextDocument.URI
+	src := s.docs[uri]
+	tokens := lexAll(src)
+	token, _, isIdentifier := identifierAt(tokens, lspPositionOffset(src, params.Position))
+	if _, isBuiltin := lspBuiltins[token.val]; !isIdentifier || isBuiltin {
+		return nil
+	}
+	for i, other := range tokens {
+		if other.typ != TokenIdentifier || other.val != token.val || i > 0 && tokens[i - 1].typ == TokenDot {
+			continue
+		}
+		if i + 1 < len(tokens) && isAssignToken(tokens[i + 1].typ) {
+			return map[string]interface{} {
+				"uri": uri,
+				"range": s.rangeOf(src, other.pos, len(other.val)),
+			}
+		}
+	}
+	return nil
+}
+
+func (s *lspServer) formatting(uri string) (interface{}, error) {
+	src := s.docs[uri]
+	formatted, err := Format(src)
+	if err != nil {
+		return nil, err
+	}
+	if formatted == src {
+		return []interface{} {}, nil
+	}
+	return []interface{} {
+		map[string]interface{} {
+			"range": s.rangeOf(src, 0, len(src)),
+			"newText": formatted,
+		},
+	}, nil
+}
+
+func (s *lspServer) handle(request lspRequest) (result interface{}, err error) {
+	var params struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+	}
+	var position lspTextDocumentPosition
+	if len(request.Params) > 0 {
+		err = json.Unmarshal(request.Params, &params)
+		if err == nil {
+			err = json.Unmarshal(request.Params, &position)
+		}
+		if err != nil {
+			return nil, &lspError {lspInvalidParams, err.Error()}
+		}
+	}
+	uri := params.TextDocument.URI
+	switch request.Method {
+		case "initialize":
+			return map[string]interface{} {
+				"capabilities": map[string]interface{} {
+					// Whole documents are sent on every change
+					"textDocumentSync": 1,
+					"hoverProvider": true,
+					"completionProvider": map[string]interface{} {},
+					"definitionProvider": true,
+					"documentFormattingProvider": true,
+				},
+				"serverInfo": map[string]string {"name": "treek"},
+			}, nil
+		case "shutdown":
+			return nil, nil
+		case "textDocument/didOpen":
+			s.docs[uri] = params.TextDocument.Text
+			return nil, s.diagnostics(uri)
+		case "textDocument/didChange":
+			if len(params.ContentChanges) > 0 {
+				s.docs[uri] = params.ContentChanges[len(params.ContentChanges) - 1].Text
+			}
+			return nil, s.diagnostics(uri)
+		case "textDocument/didClose":
+			delete(s.docs, uri)
+			return nil, nil
+		case "textDocument/hover":
+			return s.hover(position), nil
+		case "textDocument/completion":
+			return s.completion(position), nil
+		case "textDocument/definition":
+			return s.definition(position), nil
+		case "textDocument/formatting":
+			result, err := s.formatting(uri)
+			if err != nil {
+				// Nothing to do for programs that don't parse, the
+				// diagnostics already say why
+				return []interface{} {}, nil
+			}
+			return result, nil
+	}
+	if request.ID == nil {
+		return nil, nil
+	}
+	return nil, &lspError {lspMethodNotFound, "Unknown method " + request.Method}
+}
+
+func (err *lspError) Error() string {
+	return err.Message
+}
+
+// Serves the language server protocol for treek programs, reading requests
+// from in and writing responses to out until the client says to exit
+func ServeLSP(in io.Reader, out io.Writer) error {
+	s := &lspServer {
+		in: bufio.NewReader(in),
+		out: out,
+		docs: make(map[string]string),
+	}
+	for {
+		request, err := s.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if request.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(request)
+		if request.ID == nil {
+			if err != nil {
+				var protocolErr *lspError
+				if !errors.As(err, &protocolErr) {
+					return err
+				}
+			}
+			continue
+		}
+		var protocolErr *lspError
+		if errors.As(err, &protocolErr) {
+			err = s.write(lspErrorResponse {"2.0", request.ID, *protocolErr})
+		} else if err != nil {
+			return err
+		} else {
+			err = s.write(lspResponse {"2.0", request.ID, result})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
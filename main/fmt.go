@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+
+	"github.com/shtanton/treek"
+)
+
+// treek fmt [--check] [-w] [file...]
+func fmtCommand(args []string) {
+	check := false
+	write := false
+	var files []string
+	for _, arg := range args {
+		switch arg {
+			case "--check":
+				check = true
+			case "-w":
+				write = true
+			default:
+				files = append(files, arg)
+		}
+	}
+	if len(files) == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fail(err)
+		}
+		formatted, err := treek.Format(string(src))
+		if err != nil {
+			fail(fmt.Errorf("<stdin>: %v", err))
+		}
+		if check {
+			if formatted != string(src) {
+				fmt.Fprintln(stdout, "<stdin>")
+				stdout.Flush()
+				os.Exit(1)
+			}
+			return
+		}
+		fmt.Fprint(stdout, formatted)
+		return
+	}
+	unformatted := false
+	for _, filename := range files {
+		src, err := os.ReadFile(filename)
+		if err != nil {
+			fail(err)
+		}
+		formatted, err := treek.Format(string(src))
+		if err != nil {
+			fail(fmt.Errorf("%s: %v", filename, err))
+		}
+		switch {
+			case check:
+				if formatted != string(src) {
+					fmt.Fprintln(stdout, filename)
+					unformatted = true
+				}
+			case write:
+				if formatted != string(src) {
+					info, err := os.Stat(filename)
+					if err != nil {
+						fail(err)
+					}
+					err = os.WriteFile(filename, []byte(formatted), info.Mode().Perm())
+					if err != nil {
+						fail(err)
+					}
+				}
+			default:
+				fmt.Fprint(stdout, formatted)
+		}
+	}
+	if unformatted {
+		stdout.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"bufio"
+	"strings"
+	"unicode"
+)
+
+// Reads lines from a terminal with editing, history and tab completion, or
+// just reads lines if stdin isn't a terminal
+type lineEditor struct {
+	in *bufio.Reader
+	out io.Writer
+	history []string
+	// Given the line up to the cursor, where the word being completed starts
+	// and what it could be completed to
+	complete func(line string) (start int, candidates []string)
+
+	prompt string
+	line []rune
+	cursor int
+}
+
+func newLineEditor(complete func(string) (int, []string)) *lineEditor {
+	return &lineEditor {
+		in: bufio.NewReader(os.Stdin),
+		out: os.Stdout,
+		complete: complete,
+	}
+}
+
+func (e *lineEditor) addHistory(line string) {
+	if len(e.history) > 0 && e.history[len(e.history) - 1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+}
+
+// Returns io.EOF at the end of input or if ctrl-D is pressed on an empty line
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	restore, isTerminal := makeRaw(int(os.Stdin.Fd()))
+	if !isTerminal {
+		line, err := e.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	defer restore()
+	e.prompt = prompt
+	e.line = nil
+	e.cursor = 0
+	// Where we are in the history, len(history) being the line being typed
+	historyIndex := len(e.history)
+	var typed []rune
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+			case '\r', '\n':
+				fmt.Fprint(e.out, "\n")
+				return string(e.line), nil
+			case 3: // ctrl-C
+				fmt.Fprint(e.out, "^C\n")
+				e.line = nil
+				e.cursor = 0
+				historyIndex = len(e.history)
+			case 4: // ctrl-D
+				if len(e.line) == 0 {
+					fmt.Fprint(e.out, "\n")
+					return "", io.EOF
+				}
+				e.deleteForward()
+			case 127, 8: // backspace
+				if e.cursor > 0 {
+					e.cursor -= 1
+					e.deleteForward()
+				}
+			case 1: // ctrl-A
+				e.cursor = 0
+			case 5: // ctrl-E
+				e.cursor = len(e.line)
+			case 21: // ctrl-U
+				e.line = e.line[e.cursor:]
+				e.cursor = 0
+			case 11: // ctrl-K
+				e.line = e.line[:e.cursor]
+			case '\t':
+				e.tab()
+			case 27: // escape sequence, for arrow keys and so on
+				if b, _ := e.in.ReadByte(); b != '[' {
+					break
+				}
+				b, _ := e.in.ReadByte()
+				switch b {
+					case 'A', 'B':
+						if historyIndex == len(e.history) {
+							typed = e.line
+						}
+						if b == 'A' && historyIndex > 0 {
+							historyIndex -= 1
+						} else if b == 'B' && historyIndex < len(e.history) {
+							historyIndex += 1
+						}
+						if historyIndex == len(e.history) {
+							e.line = typed
+						} else {
+							e.line = []rune(e.history[historyIndex])
+						}
+						e.cursor = len(e.line)
+					case 'C':
+						if e.cursor < len(e.line) {
+							e.cursor += 1
+						}
+					case 'D':
+						if e.cursor > 0 {
+							e.cursor -= 1
+						}
+					case 'H':
+						e.cursor = 0
+					case 'F':
+						e.cursor = len(e.line)
+					case '3':
+						if b, _ := e.in.ReadByte(); b == '~' {
+							e.deleteForward()
+						}
+				}
+			default:
+				if unicode.IsPrint(r) {
+					e.insert([]rune{r})
+				}
+		}
+		e.redraw()
+	}
+}
+
+func (e *lineEditor) insert(runes []rune) {
+	line := make([]rune, 0, len(e.line) + len(runes))
+	line = append(line, e.line[:e.cursor]...)
+	line = append(line, runes...)
+	e.line = append(line, e.line[e.cursor:]...)
+	e.cursor += len(runes)
+}
+
+func (e *lineEditor) deleteForward() {
+	if e.cursor < len(e.line) {
+		e.line = append(e.line[:e.cursor:e.cursor], e.line[e.cursor + 1:]...)
+	}
+}
+
+func (e *lineEditor) redraw() {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", e.prompt, string(e.line))
+	if e.cursor < len(e.line) {
+		fmt.Fprintf(e.out, "\x1b[%dD", len(e.line) - e.cursor)
+	}
+}
+
+// Completes as much of the word before the cursor as all the candidates
+// agree on, listing them if that doesn't get any further
+func (e *lineEditor) tab() {
+	if e.complete == nil {
+		return
+	}
+	before := string(e.line[:e.cursor])
+	start, candidates := e.complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+	word := before[start:]
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			runes := []rune(common)
+			common = string(runes[:len(runes) - 1])
+		}
+	}
+	if len(common) > len(word) && strings.HasPrefix(common, word) {
+		e.insert([]rune(common[len(word):]))
+		return
+	}
+	if len(candidates) > 1 {
+		fmt.Fprintf(e.out, "\n%s\n", strings.Join(candidates, "  "))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"fmt"
+
+	"github.com/shtanton/treek"
+)
+
+// treek lint [--sample FILE] [-e PROGRAM] [file...]
+func lintCommand(args []string) {
+	var sample treek.Value
+	type source struct {
+		name string
+		program string
+	}
+	var sources []source
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		switch arg {
+			case "--sample", "-e":
+				if len(args) == 0 {
+					usage()
+				}
+				value := args[0]
+				args = args[1:]
+				if arg == "-e" {
+					sources = append(sources, source {"-e", value})
+					continue
+				}
+				file, err := os.Open(value)
+				if err != nil {
+					fail(err)
+				}
+				sample, err = treek.ReadJson(file)
+				file.Close()
+				if err != nil {
+					fail(fmt.Errorf("%s: %v", value, err))
+				}
+			default:
+				src, err := os.ReadFile(arg)
+				if err != nil {
+					fail(err)
+				}
+				sources = append(sources, source {arg, string(src)})
+		}
+	}
+	if len(sources) == 0 {
+		usage()
+	}
+	problems := false
+	for _, s := range sources {
+		diagnostics, err := treek.Lint(s.program, nil, sample)
+		if err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", s.name, err)
+			problems = true
+			continue
+		}
+		for _, diagnostic := range diagnostics {
+			fmt.Fprintf(stdout, "%s:%v\n", s.name, diagnostic)
+			problems = true
+		}
+	}
+	if problems {
+		stdout.Flush()
+		os.Exit(1)
+	}
+}
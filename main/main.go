@@ -1,29 +1,260 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"bufio"
+	"bytes"
+	"strings"
+	"strconv"
+	"path/filepath"
+
+	"github.com/shtanton/treek"
 )
 
-type TreePathSegment interface{}
-type TreeData struct {
-	path []TreePathSegment
-	value Value
+var stdout = bufio.NewWriter(os.Stdout)
+
+// Flushes stdout before writing to stderr, so what's printed to each comes
+// out in the order it was printed
+type orderedStderr struct {}
+
+func (orderedStderr) Write(p []byte) (int, error) {
+	stdout.Flush()
+	return os.Stderr.Write(p)
+}
+
+var stderr orderedStderr
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: treek [-i[SUFFIX]] [-j N] [--decimal] [--strict] program [file...]")
+	fmt.Fprintln(os.Stderr, "       treek --dump|--tokens program")
+	fmt.Fprintln(os.Stderr, "       treek --trace[=PATH] program [file...]")
+	fmt.Fprintln(os.Stderr, "       treek --repl file")
+	fmt.Fprintln(os.Stderr, "       treek fmt [--check] [-w] [file...]")
+	fmt.Fprintln(os.Stderr, "       treek lint [--sample FILE] [-e PROGRAM] [file...]")
+	fmt.Fprintln(os.Stderr, "       treek lsp")
+	fmt.Fprintln(os.Stderr, "       treek test [dir|file...]")
+	os.Exit(1)
+}
+
+func fail(err error) {
+	stdout.Flush()
+	fmt.Fprintf(os.Stderr, "treek: %v\n", err)
+	os.Exit(1)
+}
+
+// Runs the program over the file and atomically replaces it with the edited
+// document. The file is left alone if anything goes wrong before the rename.
+func editInPlace(program *treek.Program, filename string, suffix string) (err error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	doc, err := treek.ReadJsonDocument(original)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	data, err := program.RunValue(context.Background(), doc.Value(), stdout)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	var output bytes.Buffer
+	err = doc.Write(&output, data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "." + filepath.Base(filename) + ".treek-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	_, err = tmp.Write(output.Bytes())
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	if suffix != "" {
+		err = os.WriteFile(filename + suffix, original, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), filename)
 }
-type TreeStream chan TreeData
 
 func main() {
-	if len(os.Args) < 2 {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+			case "fmt":
+				fmtCommand(args[1:])
+				stdout.Flush()
+				return
+			case "lint":
+				lintCommand(args[1:])
+				stdout.Flush()
+				return
+			case "test":
+				testCommand(args[1:])
+				stdout.Flush()
+				return
+			case "lsp":
+				err := treek.ServeLSP(os.Stdin, os.Stdout)
+				if err != nil {
+					fail(err)
+				}
+				return
+		}
+	}
+	inPlace := false
+	suffix := ""
+	workers := 1
+	dump := false
+	tokens := false
+	trace := false
+	tracePrefix := ""
+	decimal := false
+	strict := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		switch {
+			case arg == "--":
+			case arg == "--decimal":
+				decimal = true
+				continue
+			case arg == "--strict":
+				strict = true
+				continue
+			case arg == "--dump":
+				dump = true
+				continue
+			case arg == "--repl":
+				if len(args) != 1 {
+					usage()
+				}
+				defer stdout.Flush()
+				repl(args[0])
+				return
+			case arg == "--tokens":
+				tokens = true
+				continue
+			case arg == "--trace" || strings.HasPrefix(arg, "--trace="):
+				trace = true
+				tracePrefix = strings.TrimPrefix(arg[len("--trace"):], "=")
+				continue
+			case strings.HasPrefix(arg, "-i"):
+				inPlace = true
+				suffix = arg[2:]
+				continue
+			case strings.HasPrefix(arg, "-j"):
+				n := arg[2:]
+				if n == "" && len(args) > 0 {
+					n = args[0]
+					args = args[1:]
+				}
+				var err error
+				workers, err = strconv.Atoi(n)
+				if err != nil || workers < 1 {
+					usage()
+				}
+				continue
+			default:
+				usage()
+		}
+		break
+	}
+	if len(args) < 1 {
 		fmt.Println("Missing program arg")
 		return
 	}
-	input := os.Args[1]
-	tokens := Lex(input)
-	program := Parse(tokens)
-	
-	stdin := bufio.NewReader(os.Stdin)
-	data := Json(stdin)
-	
-	Eval(program, data)
+	input := args[0]
+	files := args[1:]
+	defer stdout.Flush()
+	if tokens {
+		treek.DumpTokens(input, stdout)
+		return
+	}
+	program, err := treek.Compile(input)
+	if err != nil {
+		fail(err)
+	}
+	if dump {
+		program.Dump(stdout)
+		return
+	}
+	if decimal {
+		program.Numbers = treek.NumbersDecimal
+	}
+	program.Strict = strict
+	if trace {
+		program.Trace = treek.Trace {Out: stderr, Prefix: tracePrefix}
+		// Traces from records running at the same time would be jumbled up
+		workers = 1
+	}
+	if workers == 1 || inPlace {
+		// Records running at the same time can't flush stdout, which is
+		// being written to by whichever record finished last
+		program.Stderr = stderr
+	}
+
+	if inPlace {
+		if len(files) == 0 {
+			fail(fmt.Errorf("-i needs at least one file"))
+		}
+		for _, filename := range files {
+			err := editInPlace(program, filename, suffix)
+			if err != nil {
+				fail(err)
+			}
+		}
+		return
+	}
+
+	run := func(r *bufio.Reader) error {
+		if workers > 1 {
+			return program.RunParallel(context.Background(), r, stdout, workers)
+		}
+		return program.Run(context.Background(), r, stdout)
+	}
+	if len(files) == 0 {
+		err := run(bufio.NewReader(os.Stdin))
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	for _, filename := range files {
+		file, err := os.Open(filename)
+		if err != nil {
+			fail(err)
+		}
+		err = run(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			fail(fmt.Errorf("%s: %v", filename, err))
+		}
+	}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/shtanton/treek"
+)
+
+const replHelp = `Type a program to run it on the document, like people.*.name or
+people.* {n += 1} {println(n)}. Variables and edits carry over to the next.
+
+:ls [path]  list the keys or indices at path, or at the root
+:print      print the document as it is now
+:help       show this
+:quit       leave, as does ctrl-D`
+
+// The path segments before the word being typed and what's typed of it so far
+func splitPath(text string) (path []string, partial string) {
+	segments := strings.Split(text, ".")
+	path = segments[:len(segments) - 1]
+	if len(path) > 0 && path[0] == "" {
+		return nil, segments[len(segments) - 1]
+	}
+	return path, segments[len(segments) - 1]
+}
+
+// Completes a path to one of the keys in the document
+func (r *replSession) complete(line string) (int, []string) {
+	start := strings.LastIndexFunc(line, func(c rune) bool {
+		return c != '.' && c != '_' && !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}) + 1
+	path, partial := splitPath(line[start:])
+	var candidates []string
+	for _, child := range r.session.Children(path) {
+		if strings.HasPrefix(child, partial) {
+			candidates = append(candidates, strings.Join(append(path, child), "."))
+		}
+	}
+	return start, candidates
+}
+
+type replSession struct {
+	session *treek.Session
+}
+
+func (r *replSession) command(line string) (quit bool) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+		case ":quit", ":q":
+			return true
+		case ":help", ":h":
+			fmt.Fprintln(stdout, replHelp)
+		case ":ls":
+			var path []string
+			if len(fields) > 1 {
+				path = strings.Split(fields[1], ".")
+			}
+			for _, child := range r.session.Children(path) {
+				fmt.Fprintln(stdout, child)
+			}
+		case ":print", ":p":
+			treek.WriteJson(stdout, r.session.Value())
+		default:
+			fmt.Fprintf(stderr, "Unknown command %s, try :help\n", fields[0])
+	}
+	return false
+}
+
+func repl(filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		fail(err)
+	}
+	doc, err := treek.ReadJson(file)
+	file.Close()
+	if err != nil {
+		fail(fmt.Errorf("%s: %v", filename, err))
+	}
+	r := &replSession {
+		session: treek.NewSession(context.Background(), doc, stdout),
+	}
+	editor := newLineEditor(r.complete)
+	for {
+		line, err := editor.readLine("treek> ")
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fail(err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		editor.addHistory(line)
+		if strings.HasPrefix(line, ":") {
+			quit := r.command(line)
+			stdout.Flush()
+			if quit {
+				return
+			}
+			continue
+		}
+		program, err := treek.Compile(line)
+		if err == nil {
+			program.Stderr = stderr
+			err = r.session.Run(program)
+		}
+		stdout.Flush()
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func ioctlTermios(fd int, request uintptr, termios *syscall.Termios) bool {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(termios)))
+	return errno == 0
+}
+
+// Stops the terminal echoing and buffering lines so keys can be read as they
+// are pressed. Returns a function to put it back, or false if fd isn't a
+// terminal.
+func makeRaw(fd int) (restore func(), ok bool) {
+	var old syscall.Termios
+	if !ioctlTermios(fd, syscall.TCGETS, &old) {
+		return nil, false
+	}
+	// Output is still processed, so \n still goes back to the start of the line
+	raw := old
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ISIG | syscall.IEXTEN
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if !ioctlTermios(fd, syscall.TCSETS, &raw) {
+		return nil, false
+	}
+	return func() {
+		ioctlTermios(fd, syscall.TCSETS, &old)
+	}, true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Line editing is only supported on linux, elsewhere lines are read as typed
+func makeRaw(fd int) (restore func(), ok bool) {
+	return nil, false
+}
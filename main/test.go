@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"path/filepath"
+
+	"github.com/shtanton/treek"
+)
+
+// A program, what to run it on and what it should do
+type testCase struct {
+	name string
+	program string
+	input string
+	output string
+	exit int
+}
+
+// Reads test cases from # input:, # output: and # exit: comments in a
+// script, each case starting at a # test: comment
+func annotatedCases(name string, program string) []testCase {
+	var cases []testCase
+	var current *testCase
+	var input, output []string
+	finish := func() {
+		if current == nil {
+			return
+		}
+		current.input = strings.Join(input, "\n")
+		if len(output) > 0 {
+			current.output = strings.Join(output, "\n") + "\n"
+		}
+		cases = append(cases, *current)
+		input, output = nil, nil
+	}
+	for _, line := range strings.Split(program, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, isAnnotation := strings.Cut(strings.TrimSpace(line[1:]), ":")
+		if !isAnnotation {
+			continue
+		}
+		value = strings.TrimPrefix(value, " ")
+		switch key {
+			case "test":
+				finish()
+				current = &testCase {name: name + ": " + value, program: program}
+			case "input", "output", "exit":
+				if current == nil {
+					current = &testCase {name: name, program: program}
+				}
+				switch key {
+					case "input":
+						input = append(input, value)
+					case "output":
+						output = append(output, value)
+					case "exit":
+						exit, err := strconv.Atoi(value)
+						if err != nil {
+							fail(fmt.Errorf("%s: bad exit code %q", name, value))
+						}
+						current.exit = exit
+				}
+		}
+	}
+	finish()
+	return cases
+}
+
+// Without annotations a script x.treek is run on x.json and should print
+// x.out and exit with the code in x.exit, or 0 if there isn't one
+func fileCase(filename string, program string) (testCase, bool) {
+	base := strings.TrimSuffix(filename, ".treek")
+	input, err := os.ReadFile(base + ".json")
+	if err != nil {
+		return testCase {}, false
+	}
+	output, err := os.ReadFile(base + ".out")
+	if err != nil {
+		return testCase {}, false
+	}
+	exit := 0
+	exitCode, err := os.ReadFile(base + ".exit")
+	if err == nil {
+		exit, err = strconv.Atoi(strings.TrimSpace(string(exitCode)))
+		if err != nil {
+			fail(fmt.Errorf("%s.exit: bad exit code", base))
+		}
+	}
+	return testCase {filename, program, string(input), string(output), exit}, true
+}
+
+func findCases(paths []string) []testCase {
+	var scripts []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fail(err)
+		}
+		if !info.IsDir() {
+			scripts = append(scripts, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(filename string, entry os.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() && strings.HasSuffix(filename, ".treek") {
+				scripts = append(scripts, filename)
+			}
+			return err
+		})
+		if err != nil {
+			fail(err)
+		}
+	}
+	var cases []testCase
+	for _, filename := range scripts {
+		program, err := os.ReadFile(filename)
+		if err != nil {
+			fail(err)
+		}
+		annotated := annotatedCases(filename, string(program))
+		if len(annotated) > 0 {
+			cases = append(cases, annotated...)
+		} else if c, hasFiles := fileCase(filename, string(program)); hasFiles {
+			cases = append(cases, c)
+		}
+	}
+	return cases
+}
+
+// Runs a case the way the command would, giving what it would print and the
+// code it would exit with
+func runCase(c testCase) (string, int) {
+	var out bytes.Buffer
+	program, err := treek.Compile(c.program)
+	if err == nil {
+		program.Stderr = stderr
+		err = program.Run(context.Background(), strings.NewReader(c.input), &out)
+	}
+	if err != nil {
+		return out.String(), 1
+	}
+	return out.String(), 0
+}
+
+// Line by line differences, from the longest common subsequence of lines
+func diffLines(expected string, actual string) string {
+	a := strings.SplitAfter(expected, "\n")
+	b := strings.SplitAfter(actual, "\n")
+	lcs := make([][]int, len(a) + 1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b) + 1)
+	}
+	for i := len(a) - 1; i >= 0; i -= 1 {
+		for j := len(b) - 1; j >= 0; j -= 1 {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i + 1][j + 1] + 1
+			} else if lcs[i + 1][j] >= lcs[i][j + 1] {
+				lcs[i][j] = lcs[i + 1][j]
+			} else {
+				lcs[i][j] = lcs[i][j + 1]
+			}
+		}
+	}
+	var diff strings.Builder
+	line := func(prefix string, text string) {
+		if text == "" {
+			return
+		}
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n\\ No newline at end\n"
+		}
+		diff.WriteString(prefix + text)
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+			case i < len(a) && j < len(b) && a[i] == b[j]:
+				line("  ", a[i])
+				i, j = i + 1, j + 1
+			case i < len(a) && (j == len(b) || lcs[i + 1][j] >= lcs[i][j + 1]):
+				line("- ", a[i])
+				i += 1
+			default:
+				line("+ ", b[j])
+				j += 1
+		}
+	}
+	return diff.String()
+}
+
+// treek test [dir|file...]
+func testCommand(args []string) {
+	if len(args) == 0 {
+		args = []string {"."}
+	}
+	cases := findCases(args)
+	if len(cases) == 0 {
+		fail(fmt.Errorf("no test cases found"))
+	}
+	failed := 0
+	for _, c := range cases {
+		output, exit := runCase(c)
+		if output == c.output && exit == c.exit {
+			fmt.Fprintf(stdout, "ok   %s\n", c.name)
+			continue
+		}
+		failed += 1
+		fmt.Fprintf(stdout, "FAIL %s\n", c.name)
+		if exit != c.exit {
+			fmt.Fprintf(stdout, "exit code %v, expected %v\n", exit, c.exit)
+		}
+		if output != c.output {
+			fmt.Fprint(stdout, diffLines(c.output, output))
+		}
+	}
+	fmt.Fprintf(stdout, "%v passed, %v failed\n", len(cases) - failed, failed)
+	if failed > 0 {
+		stdout.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,109 @@
+package treek
+
+import (
+	"sort"
+)
+
+// The patterns of a program merged into a trie over their segments. Walking
+// it alongside the document tells us which blocks could match each node, and
+// lets us skip whole subtrees that no pattern reaches.
+type patternTrie struct {
+	index map[string]*patternTrie
+	all *patternTrie
+	filters []*patternTrie
+	// Filter on the segment leading here, if it was a filter segment
+	filter Expression
+	// Blocks whose patterns end here, in program order
+	blocks []int
+	// Whether some block here wants the node as $0
+	needsNode bool
+}
+
+func newPatternTrie() *patternTrie {
+	return &patternTrie {
+		index: make(map[string]*patternTrie),
+	}
+}
+
+func (trie *patternTrie) child(segment PatternSegment) *patternTrie {
+	switch segment.(type) {
+		case PatternSegmentIndex:
+			key := string(segment.(PatternSegmentIndex))
+			child, hasChild := trie.index[key]
+			if !hasChild {
+				child = newPatternTrie()
+				trie.index[key] = child
+			}
+			return child
+		case PatternSegmentBasic:
+			if trie.all == nil {
+				trie.all = newPatternTrie()
+			}
+			return trie.all
+		case PatternSegmentFilter:
+			// Filters can't be merged, they might do anything
+			child := newPatternTrie()
+			child.filter = segment.(PatternSegmentFilter).expr
+			child.needsNode = usesVariable(child.filter, "$0")
+			trie.filters = append(trie.filters, child)
+			return child
+		default:
+			panic("Invalid pattern segment")
+	}
+}
+
+func compilePatterns(blocks []Block) *patternTrie {
+	root := newPatternTrie()
+	for i, block := range blocks {
+		node := root
+		for _, segment := range block.pattern.segments {
+			node = node.child(segment)
+		}
+		node.blocks = append(node.blocks, i)
+		if block.needsNode() {
+			node.needsNode = true
+		}
+	}
+	return root
+}
+
+// The trie nodes that the path to a node could have reached
+type matchSet []*patternTrie
+
+func (set matchSet) step(segment TreePathSegment) matchSet {
+	key := pathSegmentString(segment)
+	var next matchSet
+	for _, node := range set {
+		child, hasChild := node.index[key]
+		if hasChild {
+			next = append(next, child)
+		}
+		if node.all != nil {
+			next = append(next, node.all)
+		}
+		next = append(next, node.filters...)
+	}
+	return next
+}
+
+// Blocks that could match the node, in program order
+func (set matchSet) blocks() []int {
+	if len(set) == 1 {
+		return set[0].blocks
+	}
+	var blocks []int
+	for _, node := range set {
+		blocks = append(blocks, node.blocks...)
+	}
+	sort.Ints(blocks)
+	return blocks
+}
+
+func (set matchSet) needsNode() bool {
+	for _, node := range set {
+		if node.needsNode {
+			return true
+		}
+	}
+	return false
+}
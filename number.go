@@ -0,0 +1,328 @@
+package treek
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// How a program does arithmetic on numbers that aren't integers. Integers are
+// always exact, growing past 64 bits when they need to.
+type NumberMode int
+
+const (
+	// Numbers that aren't integers are float64s
+	NumbersFloat NumberMode = iota
+	// Numbers that aren't integers are exact decimals, so 0.1 + 0.2 is 0.3
+	NumbersDecimal
+)
+
+type numberKind int
+
+const (
+	numberInt numberKind = iota
+	numberBig
+	numberFloat
+	numberDecimal
+)
+
+// A number is an int64 while it fits in one. A number that came from the
+// input remembers how it was written there, so that it's written back the
+// same way for as long as it's unchanged.
+type ValueNumber struct {
+	kind numberKind
+	int int64
+	big *big.Int
+	float float64
+	decimal *big.Rat
+	text string
+}
+
+func intNumber(n int64) ValueNumber {
+	return ValueNumber {kind: numberInt, int: n}
+}
+
+func floatNumber(f float64) ValueNumber {
+	return ValueNumber {kind: numberFloat, float: f}
+}
+
+func bigNumber(n *big.Int) ValueNumber {
+	if n.IsInt64() {
+		return intNumber(n.Int64())
+	}
+	return ValueNumber {kind: numberBig, big: n}
+}
+
+func decimalNumber(r *big.Rat) ValueNumber {
+	if r.IsInt() {
+		return bigNumber(new(big.Int).Set(r.Num()))
+	}
+	return ValueNumber {kind: numberDecimal, decimal: r}
+}
+
+// Parses a number written the way JSON or Go would write one
+func parseNumber(text string) (ValueNumber, bool) {
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err == nil {
+		return intNumber(n), true
+	}
+	b, isInt := new(big.Int).SetString(text, 10)
+	if isInt {
+		return bigNumber(b), true
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return ValueNumber {}, false
+	}
+	return floatNumber(f), true
+}
+
+// A number read from text that should be written back out as that same text
+func readNumber(text string) ValueNumber {
+	n, isNumber := parseNumber(text)
+	if !isNumber {
+		panic("Invalid number: " + text)
+	}
+	n.text = text
+	return n
+}
+
+func (v ValueNumber) isInteger() bool {
+	return v.kind == numberInt || v.kind == numberBig
+}
+
+func (v ValueNumber) isZero() bool {
+	switch v.kind {
+		case numberInt:
+			return v.int == 0
+		case numberBig:
+			return v.big.Sign() == 0
+		case numberDecimal:
+			return v.decimal.Sign() == 0
+		default:
+			return v.float == 0
+	}
+}
+
+func (v ValueNumber) toFloat() float64 {
+	switch v.kind {
+		case numberInt:
+			return float64(v.int)
+		case numberBig:
+			f, _ := new(big.Float).SetInt(v.big).Float64()
+			return f
+		case numberDecimal:
+			f, _ := v.decimal.Float64()
+			return f
+		default:
+			return v.float
+	}
+}
+
+// The nearest int, for using a number as an index or a count
+func (v ValueNumber) toInt() int {
+	if v.kind == numberInt {
+		return int(v.int)
+	}
+	return int(math.Round(v.toFloat()))
+}
+
+func (v ValueNumber) toBig() *big.Int {
+	if v.kind == numberBig {
+		return v.big
+	}
+	return big.NewInt(v.int)
+}
+
+// The exact value of a number, if it has one. A float that was read from the
+// input is taken to be exactly what was written rather than its nearest float.
+func (v ValueNumber) toRat() (*big.Rat, bool) {
+	switch v.kind {
+		case numberInt:
+			return new(big.Rat).SetInt64(v.int), true
+		case numberBig:
+			return new(big.Rat).SetInt(v.big), true
+		case numberDecimal:
+			return v.decimal, true
+		default:
+			if v.text != "" {
+				r, isRat := new(big.Rat).SetString(v.text)
+				if isRat {
+					return r, true
+				}
+			}
+			if math.IsInf(v.float, 0) || math.IsNaN(v.float) {
+				return nil, false
+			}
+			return new(big.Rat).SetFloat64(v.float), true
+	}
+}
+
+func (v ValueNumber) String() string {
+	if v.text != "" {
+		return v.text
+	}
+	switch v.kind {
+		case numberInt:
+			return strconv.FormatInt(v.int, 10)
+		case numberBig:
+			return v.big.String()
+		case numberDecimal:
+			return formatDecimal(v.decimal)
+		default:
+			return formatFloat(v.float)
+	}
+}
+
+// Written the way encoding/json would write it
+func formatFloat(f float64) string {
+	abs := math.Abs(f)
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) || math.IsInf(f, 0) || math.IsNaN(f) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Decimals that don't end, like a third, are cut off after 34 places
+func formatDecimal(r *big.Rat) string {
+	denom := new(big.Int).Set(r.Denom())
+	places := 0
+	for _, factor := range []int64 {2, 5} {
+		count := 0
+		f := big.NewInt(factor)
+		m := new(big.Int)
+		for {
+			q, rem := new(big.Int).QuoRem(denom, f, m)
+			if rem.Sign() != 0 {
+				break
+			}
+			denom = q
+			count += 1
+		}
+		if count > places {
+			places = count
+		}
+	}
+	if denom.Cmp(big.NewInt(1)) == 0 {
+		return r.FloatString(places)
+	}
+	s := strings.TrimRight(r.FloatString(34), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// Dividing by zero is an error in every mode, as is a float too large to be
+// written as JSON
+func numberArithmetic(mode NumberMode, op InstructionBasic, a ValueNumber, b ValueNumber) ValueNumber {
+	if a.isInteger() && b.isInteger() {
+		return integerArithmetic(mode, op, a, b)
+	}
+	if mode == NumbersDecimal || a.kind == numberDecimal || b.kind == numberDecimal {
+		x, xIsRat := a.toRat()
+		y, yIsRat := b.toRat()
+		if xIsRat && yIsRat {
+			if op == InstructionDiv && y.Sign() == 0 {
+				panic("Division by zero")
+			}
+			return decimalArithmetic(op, x, y)
+		}
+	}
+	if op == InstructionDiv && b.toFloat() == 0 {
+		panic("Division by zero")
+	}
+	result := floatArithmetic(op, a.toFloat(), b.toFloat())
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		panic("Number too large")
+	}
+	return floatNumber(result)
+}
+
+func floatArithmetic(op InstructionBasic, x float64, y float64) float64 {
+	switch op {
+		case InstructionAdd:
+			return x + y
+		case InstructionSub:
+			return x - y
+		case InstructionMul:
+			return x * y
+		case InstructionDiv:
+			return x / y
+		default:
+			panic("Invalid arithmetic instruction")
+	}
+}
+
+func decimalArithmetic(op InstructionBasic, x *big.Rat, y *big.Rat) ValueNumber {
+	res := new(big.Rat)
+	switch op {
+		case InstructionAdd:
+			res.Add(x, y)
+		case InstructionSub:
+			res.Sub(x, y)
+		case InstructionMul:
+			res.Mul(x, y)
+		case InstructionDiv:
+			res.Quo(x, y)
+		default:
+			panic("Invalid arithmetic instruction")
+	}
+	return decimalNumber(res)
+}
+
+// Stays in int64 unless it would overflow. Division that doesn't come out
+// whole gives a float or a decimal, depending on the mode.
+func integerArithmetic(mode NumberMode, op InstructionBasic, a ValueNumber, b ValueNumber) ValueNumber {
+	small := a.kind == numberInt && b.kind == numberInt
+	x, y := a.int, b.int
+	switch op {
+		case InstructionAdd:
+			if small && (x + y > x) == (y > 0) {
+				return intNumber(x + y)
+			}
+			return bigNumber(new(big.Int).Add(a.toBig(), b.toBig()))
+		case InstructionSub:
+			if small && (x - y < x) == (y > 0) {
+				return intNumber(x - y)
+			}
+			return bigNumber(new(big.Int).Sub(a.toBig(), b.toBig()))
+		case InstructionMul:
+			if small && (x == 0 || (x * y) / x == y && !(x == -1 && y == math.MinInt64)) {
+				return intNumber(x * y)
+			}
+			return bigNumber(new(big.Int).Mul(a.toBig(), b.toBig()))
+		case InstructionDiv:
+			if b.isZero() {
+				panic("Division by zero")
+			}
+			if small && x % y == 0 && !(x == math.MinInt64 && y == -1) {
+				return intNumber(x / y)
+			}
+			q, rem := new(big.Int).QuoRem(a.toBig(), b.toBig(), new(big.Int))
+			if rem.Sign() == 0 {
+				return bigNumber(q)
+			}
+			r := new(big.Rat).SetFrac(a.toBig(), b.toBig())
+			if mode == NumbersDecimal {
+				return decimalNumber(r)
+			}
+			f, _ := r.Float64()
+			return floatNumber(f)
+		default:
+			panic("Invalid arithmetic instruction")
+	}
+}
+
+// Floats are compared as floats, since a float worked out from other numbers
+// is rarely exactly what was meant. Anything else is compared exactly.
+func (v ValueNumber) equalsNumber(w ValueNumber) bool {
+	if v.kind == numberInt && w.kind == numberInt {
+		return v.int == w.int
+	}
+	if v.kind == numberFloat || w.kind == numberFloat {
+		return v.toFloat() == w.toFloat()
+	}
+	x, _ := v.toRat()
+	y, _ := w.toRat()
+	return x.Cmp(y) == 0
+}
@@ -0,0 +1,55 @@
+package treek
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNumbers(t *testing.T) {
+	tests := []struct {
+		src string
+		mode NumberMode
+		want string
+	}{
+		{`{println(1 / 2, 4 / 2, 9007199254740993 + 1)}`, NumbersFloat, "0.5 2 9007199254740994\n"},
+		{`{println(0.1 + 0.2)}`, NumbersFloat, "0.30000000000000004\n"},
+		{`{println(0.1 + 0.2, 1 / 3)}`, NumbersDecimal, "0.3 0.3333333333333333333333333333333333\n"},
+		{`{println(1., 007, 1.50)}`, NumbersFloat, "1 7 1.5\n"},
+		{`{println(try {1.5 / 0} catch (e) {e})}`, NumbersFloat, "\"Division by zero\"\n"},
+		{"{println(try {1.5 * 1" + strings.Repeat("0", 400) + "} catch (e) {e})}", NumbersFloat, "\"Number too large\"\n"},
+		{`{println(try {1 / 0} catch (e) {e})}`, NumbersFloat, "\"Division by zero\"\n"},
+		{`{println(try {1.5 / 0} catch (e) {e})}`, NumbersDecimal, "\"Division by zero\"\n"},
+	}
+	for _, test := range tests {
+		program, err := Compile(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		program.Numbers = test.mode
+		var out bytes.Buffer
+		_, err = program.RunValue(context.Background(), ValueNull {}, &out)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+		} else if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.src, out.String(), test.want)
+		}
+	}
+}
+
+// Numbers from the input are written back as they were written
+func TestInputNumbers(t *testing.T) {
+	program, err := Compile(`{println($0.a, $0.b, $0.a + 0)}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = program.Run(context.Background(), strings.NewReader(`{"a": 1.50, "b": 12345678901234567890123}`), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "1.50 12345678901234567890123 1.5\n" {
+		t.Errorf("got %q", out.String())
+	}
+}
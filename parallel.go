@@ -0,0 +1,147 @@
+package treek
+
+import (
+	"io"
+	"context"
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type recordResult struct {
+	output []byte
+	failure interface{}
+}
+
+type record struct {
+	seq int
+	line []byte
+	ctx context.Context
+	result chan recordResult
+}
+
+// Once a record fails, the records after it are cancelled and no more are
+// read, while the ones before it finish so their output comes out as it
+// would have without -j
+type parallelRun struct {
+	mu sync.Mutex
+	// The earliest record that has failed, or -1
+	failed int
+	cancels map[int]context.CancelFunc
+}
+
+// Starts a record, unless one before it has already failed
+func (run *parallelRun) start(ctx context.Context, seq int) (context.Context, bool) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.failed >= 0 {
+		return nil, false
+	}
+	recordCtx, cancel := context.WithCancel(ctx)
+	run.cancels[seq] = cancel
+	return recordCtx, true
+}
+
+func (run *parallelRun) finish(seq int, result recordResult) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.cancels[seq]()
+	delete(run.cancels, seq)
+	if result.failure == nil || (run.failed >= 0 && run.failed < seq) {
+		return
+	}
+	run.failed = seq
+	for other, cancel := range run.cancels {
+		if other > seq {
+			cancel()
+		}
+	}
+}
+
+func evalRecord(ctx context.Context, program Program, line []byte) (result recordResult) {
+	var output bytes.Buffer
+	defer func() {
+		result.output = output.Bytes()
+		result.failure = recover()
+	}()
+	evalStream(ctx, program, bytes.NewReader(line), &output)
+	return
+}
+
+// Runs the program on each line of line-delimited JSON as a record of its
+// own, spread across workers, with the output of each record written out in
+// the order the records came in. This only gives the same results as
+// evalStream if no variables carry over from one record to the next.
+func evalParallel(ctx context.Context, program Program, r *bufio.Reader, out io.Writer, workers int) {
+	carried := carriedVariables(program)
+	if len(carried) > 0 {
+		panic(fmt.Sprintf("Can't run records in parallel, these variables carry over between them: %s", strings.Join(carried, ", ")))
+	}
+
+	// Each record is held to the output limit by itself too, but this is
+	// what holds them to it all together
+	out = limitOutput(out, program.Limits)
+
+	// Anything that stops the output, like hitting the output limit, stops
+	// the records that are still running too
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	run := &parallelRun {failed: -1, cancels: make(map[int]context.CancelFunc)}
+	records := make(chan record, workers)
+	// Results in input order, waiting to be written
+	results := make(chan chan recordResult, workers * 4)
+	for i := 0; i < workers; i += 1 {
+		go func() {
+			for rec := range records {
+				result := evalRecord(rec.ctx, program, rec.line)
+				run.finish(rec.seq, result)
+				rec.result <- result
+			}
+		}()
+	}
+	// Closed if writing stops early so the reader doesn't block forever
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(records)
+		defer close(results)
+		for seq := 0; ; {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				recordCtx, started := run.start(ctx, seq)
+				if !started {
+					return
+				}
+				result := make(chan recordResult, 1)
+				select {
+					case results <- result:
+					case <-done:
+						run.finish(seq, recordResult {})
+						return
+				}
+				records <- record {seq, line, recordCtx, result}
+				seq += 1
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	for result := range results {
+		res := <-result
+		out.Write(res.output)
+		if res.failure != nil {
+			panic(res.failure)
+		}
+	}
+	if readErr != nil {
+		panic(readErr.Error())
+	}
+}
@@ -0,0 +1,726 @@
+package treek
+
+import (
+	"io"
+	"fmt"
+)
+
+type InstructionBasic int
+const (
+	InstructionAdd InstructionBasic = iota
+	InstructionSub
+	InstructionDiv
+	InstructionMul
+	InstructionIgnore
+	InstructionPushNull
+	InstructionAssign
+	InstructionIndex
+	InstructionDup
+	InstructionEqual
+	InstructionNot
+	InstructionDelete
+	InstructionSlice
+	InstructionIn
+	InstructionDefault
+	InstructionSafeIndex
+)
+
+type InstructionPushNumber string
+type InstructionPushVariable string
+type InstructionPushString string
+
+type Subroutine int
+const (
+	SubroutinePrintln Subroutine = iota
+	SubroutineNum
+	SubroutineStr
+	SubroutineBool
+	SubroutineTypeof
+	SubroutineError
+	SubroutineEprintln
+)
+type InstructionCall struct {
+	subroutine Subroutine
+	nargs int
+}
+// Runs body, and if that fails runs handler with the error in variable
+type InstructionTry struct {
+	body Expression
+	variable string
+	handler Expression
+}
+// A call to a function registered by the host program
+type InstructionCallHost struct {
+	name string
+	fn HostFunc
+	nargs int
+}
+
+type Instruction interface {
+	debug(io.Writer)
+	compile(*compiler)
+}
+
+func (i InstructionBasic) debug(w io.Writer) {
+	switch i {
+		case InstructionAdd:
+			fmt.Fprintln(w, "Add")
+		case InstructionSub:
+			fmt.Fprintln(w, "Sub")
+		case InstructionDiv:
+			fmt.Fprintln(w, "Div")
+		case InstructionMul:
+			fmt.Fprintln(w, "Mul")
+		case InstructionIgnore:
+			fmt.Fprintln(w, "Ignore")
+		case InstructionPushNull:
+			fmt.Fprintln(w, "Push Null")
+		case InstructionAssign:
+			fmt.Fprintln(w, "Assign")
+		case InstructionIndex:
+			fmt.Fprintln(w, "Index")
+		case InstructionDup:
+			fmt.Fprintln(w, "Dup")
+		case InstructionEqual:
+			fmt.Fprintln(w, "Equal")
+		case InstructionNot:
+			fmt.Fprintln(w, "Not")
+		case InstructionDelete:
+			fmt.Fprintln(w, "Delete")
+		case InstructionSlice:
+			fmt.Fprintln(w, "Slice")
+		case InstructionIn:
+			fmt.Fprintln(w, "In")
+		case InstructionDefault:
+			fmt.Fprintln(w, "Default")
+		case InstructionSafeIndex:
+			fmt.Fprintln(w, "Safe Index")
+		default:
+			fmt.Fprintln(w, "Unknown Basic Instruction")
+	}
+}
+
+func (try InstructionTry) debug(w io.Writer) {
+	if try.variable == "" {
+		fmt.Fprintln(w, "Try")
+	} else {
+		fmt.Fprintf(w, "Try, catching into %v\n", try.variable)
+	}
+}
+
+func (n InstructionPushNumber) debug(w io.Writer) {
+	fmt.Fprintf(w, "Push Number: %v\n", n)
+}
+
+var subroutineNames = map[string]Subroutine {
+	"println": SubroutinePrintln,
+	"num": SubroutineNum,
+	"str": SubroutineStr,
+	"bool": SubroutineBool,
+	"typeof": SubroutineTypeof,
+	"error": SubroutineError,
+	"eprintln": SubroutineEprintln,
+}
+
+// How many arguments each subroutine takes, if it isn't any number
+var subroutineArgs = map[Subroutine]int {
+	SubroutineNum: 1,
+	SubroutineStr: 1,
+	SubroutineBool: 1,
+	SubroutineTypeof: 1,
+	SubroutineError: 1,
+}
+
+func (i InstructionCall) debug(w io.Writer) {
+	for name, subroutine := range subroutineNames {
+		if subroutine == i.subroutine {
+			fmt.Fprintf(w, "Calling %v with %v arguments\n", name, i.nargs)
+		}
+	}
+}
+
+func (i InstructionCallHost) debug(w io.Writer) {
+	fmt.Fprintf(w, "Calling host function %v with %v arguments\n", i.name, i.nargs)
+}
+
+func (s InstructionPushVariable) debug(w io.Writer) {
+	fmt.Fprintf(w, "Push variable: %v\n", s)
+}
+
+func (s InstructionPushString) debug(w io.Writer) {
+	fmt.Fprintf(w, "Push string: %q\n", s)
+}
+
+type Expression struct {
+	instructions []Instruction
+	// Where in the program each instruction came from
+	positions []int
+}
+
+func (e *Expression) add(pos int, instructions ...Instruction) {
+	for _, instruction := range instructions {
+		e.instructions = append(e.instructions, instruction)
+		e.positions = append(e.positions, pos)
+	}
+}
+
+func (e *Expression) extend(other Expression) {
+	e.instructions = append(e.instructions, other.instructions...)
+	e.positions = append(e.positions, other.positions...)
+}
+
+// The instructions of an expression along with those of any try in it
+func (e Expression) flatten() []Instruction {
+	var res []Instruction
+	for _, instruction := range e.instructions {
+		res = append(res, instruction)
+		try, isTry := instruction.(InstructionTry)
+		if isTry {
+			res = append(res, try.body.flatten()...)
+			res = append(res, try.handler.flatten()...)
+		}
+	}
+	return res
+}
+
+func (e Expression) empty() bool {
+	return len(e.instructions) == 0
+}
+
+type PatternSegmentIndex string
+type PatternSegmentFilter struct {
+	expr Expression
+	compiled compiledExpr
+}
+type PatternSegmentBasic int
+const (
+	PatternSegmentAll PatternSegmentBasic = iota
+)
+
+type PatternSegment interface {
+	debug(io.Writer)
+	matches(*EvalState, []TreePathSegment, TreePathSegment) bool
+}
+
+type Pattern struct {
+	segments []PatternSegment
+	// Where in the program each segment came from
+	positions []int
+	isFirst bool
+}
+
+func (s PatternSegmentIndex) debug(w io.Writer) {
+	fmt.Fprintf(w, "Index: %q\n", s)
+}
+
+func (s PatternSegmentFilter) debug(w io.Writer) {
+	fmt.Fprintln(w, "Filter")
+}
+
+func (s PatternSegmentBasic) debug(w io.Writer) {
+	switch s {
+		case PatternSegmentAll:
+			fmt.Fprintln(w, "All")
+		default:
+			panic("Invalid basic pattern segment")
+	}
+}
+
+type Block struct {
+	pos int
+	pattern Pattern
+	action Expression
+	compiled compiledExpr
+}
+
+type Program struct {
+	// Limits on each run of the program, none by default
+	Limits Limits
+	// Logs what each run does, if set
+	Trace Trace
+	// How numbers that aren't integers are worked with, float64 by default
+	Numbers NumberMode
+	// Makes arithmetic and indexing on values of the wrong types an error
+	// rather than converting them
+	Strict bool
+	// Where eprintln writes, os.Stderr if nil
+	Stderr io.Writer
+	blocks []Block
+	trie *patternTrie
+	src string
+}
+
+// Writes out each instruction with where in the source it came from
+func (e Expression) dump(w io.Writer, src string, indent string) {
+	for i, instruction := range e.instructions {
+		line, col := position(src, e.positions[i])
+		fmt.Fprintf(w, "%s%-8s", indent, fmt.Sprintf("%v:%v", line, col))
+		instruction.debug(w)
+		try, isTry := instruction.(InstructionTry)
+		if isTry {
+			try.body.dump(w, src, indent + "\t")
+			fmt.Fprintf(w, "%s%-8sCatch\n", indent, "")
+			try.handler.dump(w, src, indent + "\t")
+		}
+	}
+}
+
+// Writes out the parsed patterns and the instructions of every filter and
+// action, for seeing how a program was understood
+func (p Program) debug(w io.Writer) {
+	for i, block := range p.blocks {
+		if i != 0 {
+			fmt.Fprintln(w)
+		}
+		line, col := position(p.src, block.pos)
+		fmt.Fprintf(w, "Block %v at %v:%v\n", i + 1, line, col)
+		if block.pattern.isFirst {
+			fmt.Fprintln(w, "Pattern (first):")
+		} else {
+			fmt.Fprintln(w, "Pattern (last):")
+		}
+		for j, segment := range block.pattern.segments {
+			line, col := position(p.src, block.pattern.positions[j])
+			fmt.Fprintf(w, "\t%-8s", fmt.Sprintf("%v:%v", line, col))
+			segment.debug(w)
+			filter, isFilter := segment.(PatternSegmentFilter)
+			if isFilter {
+				filter.expr.dump(w, p.src, "\t\t")
+			}
+		}
+		if block.action.empty() {
+			fmt.Fprintln(w, "Action: println($0)")
+		} else {
+			fmt.Fprintln(w, "Action:")
+			block.action.dump(w, p.src, "\t")
+		}
+	}
+}
+
+type parser struct {
+	lexer *lexer
+	functions *Functions
+	prevToken Token
+	wasRewound bool
+}
+
+func (p *parser) next() Token {
+	if p.wasRewound {
+		p.wasRewound = false
+		return p.prevToken
+	}
+	p.prevToken = p.lexer.nextToken()
+	for p.prevToken.typ == TokenComment {
+		p.prevToken = p.lexer.nextToken()
+	}
+	if p.prevToken.typ == TokenErr {
+		panic("Lexing error: " + p.prevToken.val)
+	}
+	return p.prevToken
+}
+
+func (p *parser) rewind() {
+	p.wasRewound = true
+}
+
+func (p *parser) accept(typ TokenType) (string, bool) {
+	token := p.next()
+	if typ == token.typ {
+		return token.val, true
+	}
+	p.rewind()
+	return "", false
+}
+
+func (p *parser) peek() Token {
+	token := p.next()
+	p.rewind()
+	return token
+}
+
+func (p *parser) parsePatternSegment() (segment PatternSegment, pos int, action bool, eof bool) {
+	token := p.next()
+	pos = token.pos
+	switch token.typ {
+		case TokenEOF:
+			p.rewind()
+			return nil, pos, false, true
+		case TokenLBrace:
+			p.rewind()
+			return nil, pos, true, false
+		case TokenIndexPattern:
+			return PatternSegmentIndex(token.val), pos, false, false
+		case TokenLParen:
+			filter, noExpression := p.parseExpression(0)
+			if noExpression {
+				panic("Missing expression in filter")
+			}
+			_, hasCloseParen := p.accept(TokenRParen)
+			if !hasCloseParen {
+				panic("Missing close paren")
+			}
+			return PatternSegmentFilter {filter, compile(filter)}, pos, false, false
+		case TokenAst:
+			return PatternSegmentAll, pos, false, false
+		default:
+			panic("Expected pattern segment")
+	}
+}
+
+func (p *parser) parsePattern() (pattern Pattern, eof bool) {
+	_, pattern.isFirst = p.accept(TokenCircum)
+	segment, pos, action, eof := p.parsePatternSegment()
+	if eof {
+		return pattern, true
+	} else if action {
+		return pattern, false
+	}
+	pattern.segments = append(pattern.segments, segment)
+	pattern.positions = append(pattern.positions, pos)
+	for {
+		_, hasAnotherSegment := p.accept(TokenDot)
+		if !hasAnotherSegment {
+			break
+		}
+		segment, pos, action, eof := p.parsePatternSegment()
+		if eof || action {
+			panic("Expected pattern segment")
+		}
+		pattern.segments = append(pattern.segments, segment)
+		pattern.positions = append(pattern.positions, pos)
+	}
+	return pattern, false
+}
+
+var binops = map[TokenType] struct{
+	op InstructionBasic
+	left, right int
+} {
+	TokenAdd: {InstructionAdd, 10, 11},
+	TokenSub: {InstructionSub, 10, 11},
+	TokenAst: {InstructionMul, 12, 13},
+	TokenDiv: {InstructionDiv, 12, 13},
+	TokenAssign: {InstructionAssign, 3, 2},
+	TokenEqual: {InstructionEqual, 8, 9},
+	TokenDefault: {InstructionDefault, 6, 7},
+}
+
+var assigns = map[TokenType]InstructionBasic {
+	TokenAddAssign: InstructionAdd,
+	TokenSubAssign: InstructionSub,
+	TokenAstAssign: InstructionMul,
+	TokenDivAssign: InstructionDiv,
+}
+
+// Parses an expression in braces, which is null if there's nothing in them
+func (p *parser) parseBraces(after string) Expression {
+	_, hasLBrace := p.accept(TokenLBrace)
+	if !hasLBrace {
+		panic("Expected { after " + after)
+	}
+	expr, noExpression := p.parseExpression(0)
+	_, hasRBrace := p.accept(TokenRBrace)
+	if !hasRBrace {
+		panic("Missing } after " + after)
+	}
+	if noExpression {
+		expr.add(p.prevToken.pos, InstructionPushNull)
+	}
+	return expr
+}
+
+// Identifiers the parser gives a meaning of their own, rather than reading
+// them as variables or calls
+var keywords = map[string]bool {
+	"try": true,
+	"catch": true,
+	"in": true,
+	"delete": true,
+}
+
+// try {body} catch (e) {handler}, where (e) can be left out
+func (p *parser) parseTry(token Token) (expr Expression) {
+	var try InstructionTry
+	try.body = p.parseBraces("try")
+	catch, hasCatch := p.accept(TokenIdentifier)
+	if !hasCatch || catch != "catch" {
+		panic("Expected catch after try")
+	}
+	_, hasLParen := p.accept(TokenLParen)
+	if hasLParen {
+		variable, hasVariable := p.accept(TokenIdentifier)
+		if !hasVariable {
+			panic("Expected variable in catch")
+		}
+		try.variable = variable
+		_, hasRParen := p.accept(TokenRParen)
+		if !hasRParen {
+			panic("Missing ) in catch")
+		}
+	}
+	try.handler = p.parseBraces("catch")
+	expr.add(token.pos, try)
+	return expr
+}
+
+func (p *parser) parseExpression(minPower int) (expr Expression, noExpression bool) {
+	token := p.next()
+	switch token.typ {
+		case TokenEOF:
+			p.rewind()
+			return Expression {}, true
+		case TokenNot:
+			e, noExpression := p.parseExpression(14)
+			if noExpression {
+				panic("Missing expression after !")
+			}
+			expr.extend(e)
+			expr.add(token.pos, InstructionNot)
+		case TokenSub:
+			// -x is 0 - x
+			e, noExpression := p.parseExpression(14)
+			if noExpression {
+				panic("Missing expression after -")
+			}
+			expr.add(token.pos, InstructionPushNumber("0"))
+			expr.extend(e)
+			expr.add(token.pos, InstructionSub)
+		case TokenNumber:
+			_, isNumber := parseNumber(token.val)
+			if !isNumber {
+				panic("Invalid number")
+			}
+			expr.add(token.pos, InstructionPushNumber(token.val))
+		case TokenDoubleQuote:
+			s, isStringLiteral := p.accept(TokenStringLiteral)
+			if !isStringLiteral {
+				panic("Missing string literal")
+			}
+			_, stringLiteralClosed := p.accept(TokenDoubleQuote)
+			if !stringLiteralClosed {
+				panic("Missing closing quote for string literal")
+			}
+			expr.add(token.pos, InstructionPushString(s))
+		case TokenIdentifier:
+			if token.val == "try" {
+				expr.extend(p.parseTry(token))
+				break
+			}
+			_, hasLParen := p.accept(TokenLParen)
+			if token.val == "delete" {
+				// delete on its own removes $0, delete(x) removes x
+				var e Expression
+				noExpression := true
+				if hasLParen {
+					e, noExpression = p.parseExpression(0)
+					_, hasRParen := p.accept(TokenRParen)
+					if !hasRParen {
+						panic("Missing ) for delete")
+					}
+				}
+				if noExpression {
+					e.add(token.pos, InstructionPushVariable("$0"))
+				}
+				expr.extend(e)
+				expr.add(token.pos, InstructionDelete)
+			} else if hasLParen {
+				subroutine, isSubroutine := subroutineNames[token.val]
+				host, isHost := p.functions.lookup(token.val)
+				if !isSubroutine && !isHost {
+					panic("Invalid subroutine: " + token.val)
+				}
+				nargs := 0
+				for {
+					e, noExpression := p.parseExpression(0)
+					if noExpression {
+						break
+					}
+					expr.extend(e)
+					nargs += 1
+					_, hasComma := p.accept(TokenComma)
+					if !hasComma {
+						break
+					}
+				}
+				_, hasRParen := p.accept(TokenRParen)
+				if !hasRParen {
+					panic("Missing ) for subroutine call")
+				}
+				if isSubroutine {
+					want, isFixed := subroutineArgs[subroutine]
+					if isFixed && want != nargs {
+						panic(fmt.Sprintf("%v takes %v arguments but was called with %v", token.val, want, nargs))
+					}
+					expr.add(token.pos, InstructionCall {subroutine, nargs})
+				} else {
+					if host.nargs >= 0 && host.nargs != nargs {
+						panic(fmt.Sprintf("%v takes %v arguments but was called with %v", token.val, host.nargs, nargs))
+					}
+					expr.add(token.pos, InstructionCallHost {token.val, host.fn, nargs})
+				}
+			} else {
+				expr.add(token.pos, InstructionPushVariable(token.val))
+			}
+		case TokenLParen:
+			e, noExpression := p.parseExpression(0)
+			if noExpression {
+				panic("Missing expression in ()")
+			}
+			_, hasCloseParen := p.accept(TokenRParen)
+			if !hasCloseParen {
+				panic("Missing ) in expression")
+			}
+			expr.extend(e)
+		default:
+			p.rewind()
+			return Expression {}, true
+	}
+	
+	oploop: for {
+		token := p.next()
+		binop, isBinop := binops[token.typ]
+		assignInstruction, isAssign := assigns[token.typ]
+		switch {
+			case isBinop && binop.left >= minPower:
+				e, noExpression := p.parseExpression(binop.right)
+				if noExpression {
+					panic("Missing expression after operator")
+				}
+				expr.extend(e)
+				expr.add(token.pos, binop.op)
+			case isAssign && 3 >= minPower:
+				expr.add(token.pos, InstructionDup)
+				e, noExpression := p.parseExpression(2)
+				if noExpression {
+					panic("Missing expression after operator")
+				}
+				expr.extend(e)
+				expr.add(token.pos, assignInstruction, InstructionAssign)
+			case token.typ == TokenSemicolon && 0 >= minPower:
+				e, noExpression := p.parseExpression(1)
+				expr.add(token.pos, InstructionIgnore)
+				if noExpression {
+					expr.add(token.pos, InstructionPushNull)
+				} else {
+					expr.extend(e)
+				}
+			case token.typ == TokenDot && 20 >= minPower:
+				index, hasIndex := p.accept(TokenIdentifier)
+				if !hasIndex {
+					panic("Expected identifier after .")
+				}
+				expr.add(token.pos, InstructionPushString(index), InstructionIndex)
+			case token.typ == TokenSafeDot && 20 >= minPower:
+				index, hasIndex := p.accept(TokenIdentifier)
+				if !hasIndex {
+					panic("Expected identifier after ?.")
+				}
+				expr.add(token.pos, InstructionPushString(index), InstructionSafeIndex)
+			case token.typ == TokenIdentifier && token.val == "in" && 8 >= minPower:
+				e, noExpression := p.parseExpression(9)
+				if noExpression {
+					panic("Missing expression after in")
+				}
+				expr.extend(e)
+				expr.add(token.pos, InstructionIn)
+			case token.typ == TokenLBrack && 20 >= minPower:
+				start, noStart := p.parseExpression(0)
+				_, isSlice := p.accept(TokenColon)
+				if !isSlice {
+					if noStart {
+						panic("Missing index in []")
+					}
+					expr.extend(start)
+					expr.add(token.pos, InstructionIndex)
+				} else {
+					end, noEnd := p.parseExpression(0)
+					if noStart {
+						start.add(token.pos, InstructionPushNull)
+					}
+					if noEnd {
+						end.add(token.pos, InstructionPushNull)
+					}
+					expr.extend(start)
+					expr.extend(end)
+					expr.add(token.pos, InstructionSlice)
+				}
+				_, hasRBrack := p.accept(TokenRBrack)
+				if !hasRBrack {
+					panic("Missing ] after index")
+				}
+			case token.typ == TokenNotEqual && 8 >= minPower:
+				e, noExpression := p.parseExpression(9)
+				if noExpression {
+					panic("Missing expression after operator")
+				}
+				expr.extend(e)
+				expr.add(token.pos, InstructionEqual, InstructionNot)
+			default:
+				p.rewind()
+				break oploop
+		}
+	}
+	
+	return expr, false
+}
+
+// A program that doesn't lex or parse, with where the problem was noticed
+type SyntaxError struct {
+	Position
+	Message string
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("%v:%v: %v", err.Line, err.Col, err.Message)
+}
+
+func parse(lexer *lexer, functions *Functions) Program {
+	p := parser {
+		lexer: lexer,
+		functions: functions,
+		wasRewound: false,
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		message, isMessage := r.(string)
+		if !isMessage {
+			panic(r)
+		}
+		panic(&SyntaxError {positionOf(lexer.input, p.prevToken.pos), message})
+	}()
+	var blocks []Block
+	for {
+		pos := p.peek().pos
+		pattern, eof := p.parsePattern()
+		if eof {
+			break
+		}
+		_, hasAction := p.accept(TokenLBrace)
+		var action Expression
+		if hasAction {
+			action, _ = p.parseExpression(0)
+			_, hasActionClose := p.accept(TokenRBrace)
+			if !hasActionClose {
+				panic("Error: Missing } at end of action")
+			}
+		}
+		var compiled compiledExpr
+		if !action.empty() {
+			compiled = compile(action)
+		}
+		blocks = append(blocks, Block {
+			pos: pos,
+			pattern: pattern,
+			action: action,
+			compiled: compiled,
+		})
+	}
+	return Program {
+		blocks: blocks,
+		trie: compilePatterns(blocks),
+		src: lexer.input,
+	}
+}
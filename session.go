@@ -0,0 +1,75 @@
+package treek
+
+import (
+	"io"
+	"context"
+	"sort"
+	"strconv"
+)
+
+// Runs one program after another on the same document, with each seeing the
+// variables and edits left by the ones before it
+type Session struct {
+	ctx context.Context
+	data Value
+	variables map[string]Value
+	out io.Writer
+}
+
+func NewSession(ctx context.Context, doc Value, out io.Writer) *Session {
+	return &Session {
+		ctx: ctx,
+		data: doc,
+		variables: make(map[string]Value),
+		out: out,
+	}
+}
+
+// Runs a program on the document as it stands. If the program fails its
+// edits to the document are dropped, but any variables it set are kept.
+func (s *Session) Run(p *Program) (err error) {
+	defer recoverError(&err)
+	state := newEvalState(s.ctx, *p, s.data, s.out)
+	state.variables = s.variables
+	walkProgram(state, *p)
+	s.data = state.data
+	return nil
+}
+
+// The document with the edits made so far
+func (s *Session) Value() Value {
+	return s.data
+}
+
+// The keys of the map or the indices of the array at path, in order. There
+// are none if path doesn't lead to a map or an array.
+func (s *Session) Children(path []string) []string {
+	value := s.data
+	for _, segment := range path {
+		switch value.(type) {
+			case ValueMap:
+				value = value.(ValueMap)[segment]
+			case ValueArray:
+				index, err := strconv.Atoi(segment)
+				if err != nil || index < 0 || index >= len(value.(ValueArray)) {
+					return nil
+				}
+				value = value.(ValueArray)[index]
+			default:
+				return nil
+		}
+	}
+	var children []string
+	switch value.(type) {
+		case ValueMap:
+			for key := range value.(ValueMap) {
+				children = append(children, key)
+			}
+			sort.Strings(children)
+		case ValueArray:
+			for i := range value.(ValueArray) {
+				children = append(children, strconv.Itoa(i))
+			}
+	}
+	return children
+}
@@ -0,0 +1,137 @@
+package treek
+
+import (
+	"io"
+	"context"
+	"encoding/json"
+)
+
+func usesVariable(expr Expression, name string) bool {
+	for _, instruction := range expr.flatten() {
+		variable, isVariable := instruction.(InstructionPushVariable)
+		if isVariable && string(variable) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// A block with no action prints $0
+func (block Block) needsNode() bool {
+	return block.action.empty() || usesVariable(block.action, "$0")
+}
+
+// Reads the document a token at a time, only building the subtrees that a
+// block needs as $0 and walking those the same way eval would
+type streamer struct {
+	state *EvalState
+	program Program
+	dec *json.Decoder
+}
+
+func (s *streamer) visit(node TreeWalkItem) {
+	visitNode(s.state, s.program, node)
+}
+
+func (s *streamer) token() json.Token {
+	t, err := s.dec.Token()
+	if err != nil {
+		panic("Invalid JSON")
+	}
+	return t
+}
+
+// Reads past a value without building it
+func (s *streamer) skip() {
+	depth := 0
+	for {
+		delim, isDelim := s.token().(json.Delim)
+		if isDelim && (delim == '[' || delim == '{') {
+			depth += 1
+		} else if isDelim {
+			depth -= 1
+		}
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+func (s *streamer) stream(path, original []TreePathSegment, matches matchSet) {
+	if len(matches) == 0 {
+		s.skip()
+		return
+	}
+	// Traced nodes are read in too so the trace can show their $0
+	if matches.needsNode() || s.state.tracing(path) {
+		value, empty := readValue(s.dec)
+		if empty {
+			panic("Invalid JSON")
+		}
+		s.state.data = value
+		s.state.dataPath = path
+		walkPaths(s.state, path, original, matches, s.visit)
+		s.state.data = nil
+		s.state.dataPath = nil
+		return
+	}
+	s.visit(TreeWalkItem {path, original, true, matches})
+	t := s.token()
+	switch t.(type) {
+		case nil, string, json.Number, bool:
+		case json.Delim:
+			switch rune(t.(json.Delim)) {
+				case '[':
+					// Indexes shift down past deleted elements, as they do in eval
+					removed := 0
+					for i := 0; s.dec.More(); i += 1 {
+						s.stream(append(path, i - removed), append(original, i), matches.step(i))
+						if s.state.removedDepth == len(path) + 1 {
+							removed += 1
+						}
+						s.state.removedDepth = noneRemoved
+					}
+					delim, isDelim := s.token().(json.Delim)
+					if !isDelim || delim != ']' {
+						panic("Expected ] in JSON")
+					}
+				case '{':
+					for s.dec.More() {
+						key, keyIsString := s.token().(string)
+						if !keyIsString {
+							panic("Invalid JSON")
+						}
+						s.stream(append(path, key), append(original, key), matches.step(key))
+						s.state.removedDepth = noneRemoved
+					}
+					delim, isDelim := s.token().(json.Delim)
+					if !isDelim || delim != '}' {
+						panic("Expected } in JSON")
+					}
+				default:
+					panic("Error parsing JSON")
+			}
+		default:
+			panic("Invalid JSON token")
+	}
+	s.visit(TreeWalkItem {path, original, false, matches})
+}
+
+// Like eval, but without holding the whole document in memory. If the input
+// is a series of JSON values, as with line-delimited JSON, each is walked in
+// turn with the variables carrying over from one to the next.
+func evalStream(ctx context.Context, program Program, r io.Reader, out io.Writer) {
+	s := &streamer {
+		state: newEvalState(ctx, program, nil, out),
+		program: program,
+		dec: json.NewDecoder(r),
+	}
+	s.dec.UseNumber()
+	if !s.dec.More() {
+		panic("Missing JSON input")
+	}
+	for s.dec.More() {
+		s.stream(nil, nil, matchSet {program.trie})
+		s.state.removedDepth = noneRemoved
+	}
+}
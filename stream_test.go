@@ -0,0 +1,65 @@
+package treek
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStreamMatchesEval(t *testing.T) {
+	input := `{"a": [1, 2, 3], "b": {"x": 1, "y": [4, 5]}}`
+	tests := []string {
+		`a.0 {delete} a.* {println(path, $0)}`,
+		`a.1 {delete} a.* {println(path, $0)}`,
+		`a.* {delete} a.* {println(path, $0)}`,
+		`a.($0 == 2) {delete} a.2 {println(path, $0)}`,
+		`b.y.0 {delete} b.y.* {println(path, $0)}`,
+	}
+	for _, src := range tests {
+		program, err := Compile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var streamed, evaluated strings.Builder
+		if err := program.Run(context.Background(), strings.NewReader(input), &streamed); err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		value, err := ReadJson(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := program.RunValue(context.Background(), value, &evaluated); err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if streamed.String() != evaluated.String() {
+			t.Errorf("%s: streamed %q, evaluated %q", src, streamed.String(), evaluated.String())
+		}
+	}
+}
+
+func TestStreamTraceMatchesEval(t *testing.T) {
+	input := `{"people": [{"name": "a"}, {"name": "b"}]}`
+	program, err := Compile(`people.*.name {println($0)}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamed, evaluated strings.Builder
+	program.Trace = Trace {Out: &streamed, Prefix: "people.1"}
+	if err := program.Run(context.Background(), strings.NewReader(input), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	value, err := ReadJson(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.Trace = Trace {Out: &evaluated, Prefix: "people.1"}
+	if _, err := program.RunValue(context.Background(), value, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if streamed.String() != evaluated.String() {
+		t.Errorf("streamed %q, evaluated %q", streamed.String(), evaluated.String())
+	}
+}
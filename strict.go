@@ -0,0 +1,60 @@
+package treek
+
+type typePair struct {
+	lhs, rhs ValueType
+}
+
+// The operands each kind of arithmetic works on without converting either
+// of them. Null on the left is always allowed, since that's what a variable
+// that's being added up starts as.
+var strictOperands = map[InstructionBasic]map[typePair]bool {
+	InstructionAdd: {
+		{TypeNumber, TypeNumber}: true,
+		{TypeString, TypeString}: true,
+		{TypeArray, TypeArray}: true,
+		{TypeMap, TypeMap}: true,
+	},
+	InstructionSub: {
+		{TypeNumber, TypeNumber}: true,
+		{TypeString, TypeString}: true,
+		{TypeArray, TypeNumber}: true,
+		{TypeMap, TypeArray}: true,
+	},
+	InstructionMul: {
+		{TypeNumber, TypeNumber}: true,
+		{TypeString, TypeNumber}: true,
+		{TypeArray, TypeNumber}: true,
+		{TypeMap, TypeMap}: true,
+	},
+	InstructionDiv: {
+		{TypeNumber, TypeNumber}: true,
+		{TypeString, TypeString}: true,
+		{TypeArray, TypeNumber}: true,
+		{TypeMap, TypeArray}: true,
+		{TypeMap, TypeMap}: true,
+	},
+}
+
+func (state *EvalState) checkArithmetic(pos int, op InstructionBasic, l Value, r Value) {
+	if l.typ() == TypeNull || strictOperands[op][typePair {l.typ(), r.typ()}] {
+		return
+	}
+	state.failAt(pos, "%s of %s and %s isn't allowed in strict mode", arithmeticNames[op], typeNameInSentence(l.typ()), typeNameInSentence(r.typ()))
+}
+
+// Maps are indexed by strings, and arrays and strings by numbers
+func (state *EvalState) checkIndex(pos int, parent Value, index Value) {
+	switch parent.typ() {
+		case TypeNull:
+			return
+		case TypeMap:
+			if index.typ() == TypeString {
+				return
+			}
+		case TypeArray, TypeString:
+			if index.typ() == TypeNumber {
+				return
+			}
+	}
+	state.failAt(pos, "Indexing %s with %s isn't allowed in strict mode", typeNameInSentence(parent.typ()), typeNameInSentence(index.typ()))
+}
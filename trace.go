@@ -0,0 +1,81 @@
+package treek
+
+import (
+	"io"
+	"fmt"
+	"bytes"
+	"strings"
+)
+
+// Where to log what a run does at each node, for working out why a block did
+// or didn't run
+type Trace struct {
+	// Nothing is logged if this is nil
+	Out io.Writer
+	// Only nodes at or under this path are logged, written like people.3
+	Prefix string
+}
+
+func (trace Trace) prefixSegments() []string {
+	if trace.Prefix == "" {
+		return nil
+	}
+	return strings.Split(trace.Prefix, ".")
+}
+
+func (state *EvalState) tracing(path []TreePathSegment) bool {
+	if state.trace == nil || len(path) < len(state.tracePrefix) {
+		return false
+	}
+	for i, segment := range state.tracePrefix {
+		if pathSegmentString(path[i]) != segment {
+			return false
+		}
+	}
+	return true
+}
+
+func pathString(path []TreePathSegment) string {
+	if len(path) == 0 {
+		return "(root)"
+	}
+	segments := make([]string, len(path))
+	for i, segment := range path {
+		segments[i] = pathSegmentString(segment)
+	}
+	return strings.Join(segments, ".")
+}
+
+const traceValueLength = 80
+
+func (state *EvalState) traceNode(node TreeWalkItem) {
+	order := "post"
+	if node.first {
+		order = "pre"
+	}
+	var value bytes.Buffer
+	printSingle(&value, state.getNode(node.path))
+	if value.Len() > traceValueLength {
+		value.Truncate(traceValueLength)
+		value.WriteString("...")
+	}
+	fmt.Fprintf(state.trace, "%s %s: $0 = %s\n", order, pathString(node.path), value.String())
+}
+
+// Like matchPattern, but logs how the block's pattern was tested
+func (state *EvalState) traceMatch(program Program, i int, node TreeWalkItem) bool {
+	block := program.blocks[i]
+	if len(block.pattern.segments) != len(node.path) || block.pattern.isFirst != node.first {
+		return false
+	}
+	line, col := position(program.src, block.pos)
+	for j, patternSegment := range block.pattern.segments {
+		if !patternSegment.matches(state, node.path[0:j+1], node.original[j]) {
+			line, col := position(program.src, block.pattern.positions[j])
+			fmt.Fprintf(state.trace, "\tblock %v: segment %v at %v:%v is false\n", i + 1, j + 1, line, col)
+			return false
+		}
+	}
+	fmt.Fprintf(state.trace, "\tblock %v at %v:%v matches\n", i + 1, line, col)
+	return true
+}
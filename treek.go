@@ -0,0 +1,122 @@
+// Package treek runs treek programs, which are like awk but for JSON trees.
+package treek
+
+import (
+	"io"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Turns a panic from the lexer, parser or evaluator back into an error
+func recoverError(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	switch r.(type) {
+		case error:
+			*err = r.(error)
+		case string:
+			*err = errors.New(r.(string))
+		default:
+			*err = fmt.Errorf("%v", r)
+	}
+}
+
+// A function the host program makes available to treek programs. Returning
+// an error stops the program and Run returns it.
+type HostFunc func(args []Value) (Value, error)
+
+type hostFunction struct {
+	nargs int
+	fn HostFunc
+}
+
+// Host functions that programs compiled with them can call
+type Functions struct {
+	fns map[string]hostFunction
+	// Whether to accept any function at all, for checking programs without
+	// knowing what the host will register
+	any bool
+}
+
+var anyFunctions = &Functions {any: true}
+
+func NewFunctions() *Functions {
+	return &Functions {
+		fns: make(map[string]hostFunction),
+	}
+}
+
+// Makes fn callable as name(...) taking exactly nargs arguments, or any
+// number of them if nargs is negative. The number of arguments in each call
+// is checked when the program is compiled.
+func (f *Functions) Register(name string, nargs int, fn HostFunc) {
+	_, isSubroutine := subroutineNames[name]
+	if isSubroutine || keywords[name] {
+		panic("treek: can't register " + name + ", it's built in")
+	}
+	f.fns[name] = hostFunction {nargs, fn}
+}
+
+func (f *Functions) lookup(name string) (hostFunction, bool) {
+	if f == nil {
+		return hostFunction {}, false
+	}
+	if f.any {
+		return hostFunction {nargs: -1}, true
+	}
+	fn, exists := f.fns[name]
+	return fn, exists
+}
+
+// Parses a program so it can be run any number of times
+func Compile(program string) (*Program, error) {
+	return CompileWith(program, nil)
+}
+
+// Like Compile, but the program can also call the given host functions
+func CompileWith(program string, functions *Functions) (p *Program, err error) {
+	defer recoverError(&err)
+	compiled := parse(lex(program), functions)
+	return &compiled, nil
+}
+
+// Writes out the program's patterns and the instructions it was parsed into,
+// along with where each came from in the source
+func (p *Program) Dump(w io.Writer) {
+	p.debug(w)
+}
+
+// Writes out the tokens a program is made of, along with where each is in
+// the source. This works even for programs that don't parse.
+func DumpTokens(program string, w io.Writer) {
+	dumpTokens(program, w)
+}
+
+// Runs the program over each JSON value read from input in turn, with
+// variables carrying over from one to the next. Nothing is written to out but
+// what the program prints.
+func (p *Program) Run(ctx context.Context, input io.Reader, out io.Writer) (err error) {
+	defer recoverError(&err)
+	evalStream(ctx, *p, input, out)
+	return nil
+}
+
+// Runs the program over a single value and returns the value as edited by
+// the program
+func (p *Program) RunValue(ctx context.Context, input Value, out io.Writer) (result Value, err error) {
+	defer recoverError(&err)
+	return eval(ctx, *p, input, out), nil
+}
+
+// Runs the program over each line of line-delimited JSON as a separate
+// record, spread across workers. This fails if any variables would carry
+// over from one record to the next.
+func (p *Program) RunParallel(ctx context.Context, input io.Reader, out io.Writer, workers int) (err error) {
+	defer recoverError(&err)
+	evalParallel(ctx, *p, bufio.NewReader(input), out, workers)
+	return nil
+}
@@ -0,0 +1,43 @@
+package treek
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	functions := NewFunctions()
+	functions.Register("wrap", 1, func(args []Value) (Value, error) {
+		return ValueString("<" + string(args[0].castToString()) + ">"), nil
+	})
+	program, err := CompileWith(`{println(wrap("a"))}`, functions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	_, err = program.RunValue(context.Background(), ValueNull {}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "\"<a>\"\n" {
+		t.Errorf("got %q", out.String())
+	}
+	_, err = CompileWith(`{println(wrap("a", "b"))}`, functions)
+	if err == nil {
+		t.Error("calling wrap with two arguments should fail to compile")
+	}
+}
+
+func TestRegisterBuiltIn(t *testing.T) {
+	for _, name := range []string {"try", "catch", "in", "delete", "println", "error"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %s should fail", name)
+				}
+			}()
+			NewFunctions().Register(name, 1, nil)
+		}()
+	}
+}